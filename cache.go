@@ -0,0 +1,67 @@
+package var_template
+
+import (
+	"container/list"
+	"sync"
+)
+
+// compileCacheSize bounds the number of templates kept by CompileCached
+const compileCacheSize = 1024
+
+var defaultCompileCache = newCompileCache(compileCacheSize)
+
+// CompileCached is like Compile but reuses the result for identical
+// sources, keeping the most recently used templates. It is safe for
+// concurrent use. The returned template is shared and must be treated
+// as immutable: do not call Reset or UpdateVars on it
+func CompileCached(template string) *Template {
+	return defaultCompileCache.get(template)
+}
+
+// compileCache is a concurrency-safe LRU cache of compiled templates
+type compileCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used
+	entries  map[string]*list.Element
+}
+
+type compileCacheEntry struct {
+	source string
+	tmpl   *Template
+}
+
+func newCompileCache(capacity int) *compileCache {
+	return &compileCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *compileCache) get(source string) *Template {
+	c.mu.Lock()
+	if e, ok := c.entries[source]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*compileCacheEntry).tmpl
+	}
+	c.mu.Unlock()
+
+	// compile outside the lock, a concurrent miss may compile twice
+	tmpl := Compile(source)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[source]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*compileCacheEntry).tmpl
+	}
+	c.entries[source] = c.order.PushFront(&compileCacheEntry{source: source, tmpl: tmpl})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*compileCacheEntry).source)
+	}
+	return tmpl
+}
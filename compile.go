@@ -1,8 +1,13 @@
 package var_template
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 const open = "${"
@@ -20,30 +25,80 @@ const (
 // ${ a! } --> a is required
 // ${a!:%d} -> a is typeof number, and is required
 // ${ a ?:10} --> default 10
+// ${@macro?:fallback} --> fallback when the macro is unknown
+// ${\@type} --> ordinary variable named @type, not a macro
+// ${"user.name"!} --> quoted name, may contain any character except "
+// ${workers:clamp:1:64} --> integer clamped into [1, 64], unquoted like :%d
+// ${tags:idx:0} --> first item of the list value, :idx:-1 is the last
+// ${title:replace: :_} --> every space replaced by _, \: is a literal colon
+// ${partials/header.tmpl:include} --> the file rendered as a template with the same vars
+// ${tags:join:,:, } --> list split on "," and joined with ", "
+// ${token:once} --> value at the first :once occurrence of token, empty at the others
+// ${path:shell_quote_if:quoting} --> shell quoted only if quoting is truthy
+// ${port:env:PORT?:8080} --> vars, then $PORT, then 8080
+// ${items:+} --> list value split on ",", duplicates removed; :* keeps all
+// ${items:+;} --> same, split on ";"
+// ${items:uniq}, ${items:any} --> spelled-out :+ and :*
+// ${?port:::} --> ":" followed by port, or nothing if port is missing or empty
 // valid combinations:
 //
 //	${a:uniq}
 //
 // separators:  !, ?:, :,
-// accepted options:  %d, *, +, :file, :bash, :shell_quote
+// accepted options:  %d, *, +, any, uniq, :file, :bash, :shell_quote, :secret, :html, :urlencode
 type varAndPosition struct {
 	// the original raw string
 	raw             string
 	varName         string
-	varInitContent  string
+	varInitContent  string     // inner text between the delimiters, untrimmed
 	isNumber        bool       // has :%d suffix
 	repeatMode      repeatMode // :+, :*
+	listSeparator   string     // :+; splits the value on ; instead of ApplyOptions.ListSeparator
 	hasDefaultValue bool
-	defaultValue    string // has ?:something
-	required        bool   // has ! suffix
+	defaultValue    string       // has ?:something
+	defaultExpr     *defaultExpr // default references other variables, like ?:${base}*2
+	defaultTemplate *Template    // default is a template fragment, like ?:${scheme}://${host}
+	required        bool         // has ! suffix
+	envName         string       // has :env:NAME, environment fallback
 	isMacro         bool
 	// New directive fields
 	isFile       bool // has :file suffix
+	isInclude    bool // has :include suffix, the name is a template file
 	isBash       bool // has :bash suffix
 	isShellQuote bool // has :shell_quote suffix
-	open         int  // begin of ${
-	close        int  // position of }
-	index        int  // $'s position in the string (global unique)
+	isSecret     bool // has :secret suffix, redacted in errors and introspection
+	isHTML       bool // has :html suffix
+	isURLEncode  bool // has :urlencode suffix, escaped with url.QueryEscape
+	isOnce       bool // has :once suffix, later :once occurrences render empty
+	// has :shell_quote_if:VAR, :html_if:VAR or :urlencode_if:VAR,
+	// the transform only runs if VAR is truthy
+	transformIf string
+	// has :clamp:MIN:MAX, the value is an integer clamped into [clampMin, clampMax]
+	hasClamp bool
+	clampMin int64
+	clampMax int64
+	// has :idx:N, selects the N-th item of the list value
+	hasIndex  bool
+	listIndex int
+	// has :replace:FROM:TO, every FROM in the value is replaced by TO
+	hasReplace  bool
+	replaceFrom string
+	replaceTo   string
+	// has :join:SEP:WITH, items split on joinSep are trimmed and rejoined by joinWith
+	hasJoin    bool
+	joinSep    string
+	joinWith   string
+	isQuoted   bool     // name is quoted like ${"user.name"}, kept verbatim
+	directives []string // directive tokens in the order they were parsed
+	// backs directives for the common single directive, saving an allocation
+	directiveBuf [1]string
+	// conditional section ${?name::text}: renders text followed by the value,
+	// or nothing at all when the value is missing or empty
+	isConditional   bool
+	conditionalText string
+	open            int // begin of ${
+	close           int // position of }
+	index           int // $'s position in the string (global unique)
 }
 
 func (c *varAndPosition) clone() *varAndPosition {
@@ -51,7 +106,47 @@ func (c *varAndPosition) clone() *varAndPosition {
 	return &v
 }
 
+// addDirective records a parsed directive token
+func (c *varAndPosition) addDirective(d string) {
+	if c.directives == nil {
+		c.directiveBuf[0] = d
+		// full capacity, a second directive copies out of the buffer
+		c.directives = c.directiveBuf[:1:1]
+		return
+	}
+	c.directives = append(c.directives, d)
+}
+
 func (c *varAndPosition) String() string {
+	return c.display()
+}
+
+// refs returns the other variables the variable references: those of a
+// computed or fragment default, like b in ${a?:${b}}, and a transform gate
+func (c *varAndPosition) refs() []string {
+	var refs []string
+	switch {
+	case c.defaultExpr != nil:
+		for _, o := range []exprOperand{c.defaultExpr.left, c.defaultExpr.right} {
+			if o.name != "" {
+				refs = append(refs, o.name)
+			}
+		}
+	case c.defaultTemplate != nil:
+		refs = append(refs, c.defaultTemplate.vars...)
+	}
+	if c.transformIf != "" {
+		refs = append(refs, c.transformIf)
+	}
+	return refs
+}
+
+// display returns the raw spec for errors and introspection,
+// redacted for secret variables
+func (c *varAndPosition) display() string {
+	if c.isSecret {
+		return "***"
+	}
 	return c.raw
 }
 
@@ -74,6 +169,44 @@ func (c *varAndPosition) IsNumber() bool {
 	return c.isNumber
 }
 
+func (c *varAndPosition) Secret() bool {
+	return c.isSecret
+}
+
+// Directives returns the directive tokens such as %d or shell_quote,
+// in the order they appear in the variable definition
+func (c *varAndPosition) Directives() []string {
+	return c.directives
+}
+
+// RawContent returns the exact inner text between the delimiters,
+// including directives and whitespace, e.g. " name?:x " for ${ name?:x }.
+// Unlike errors it is not redacted for secret variables
+func (c *varAndPosition) RawContent() string {
+	return c.varInitContent
+}
+
+// Kind classifies the variable by how its value is produced
+func (c *varAndPosition) Kind() VarKind {
+	switch {
+	case c.isMacro:
+		return KindMacro
+	case c.isFile:
+		return KindFile
+	case c.isInclude:
+		return KindInclude
+	case c.isBash:
+		return KindBash
+	case c.isNumber:
+		return KindNumber
+	case c.isShellQuote:
+		return KindShellQuote
+	case c.isHTML:
+		return KindHTML
+	}
+	return KindPlain
+}
+
 var _ Var = (*varAndPosition)(nil)
 
 type Var interface {
@@ -82,20 +215,78 @@ type Var interface {
 	HasDefault() bool
 	IsMacro() bool
 	IsNumber() bool
+	Secret() bool
+	Directives() []string
+	Kind() VarKind
+	RawContent() string
 }
 
-// findNextDollarVar finds the next $name pattern in the string
+type VarKind int
+
+const (
+	KindPlain      VarKind = 0
+	KindNumber     VarKind = 1 // :%d
+	KindMacro      VarKind = 2 // @name
+	KindFile       VarKind = 3 // :file
+	KindBash       VarKind = 4 // :bash
+	KindShellQuote VarKind = 5 // :shell_quote
+	KindHTML       VarKind = 6 // :html
+	KindInclude    VarKind = 7 // :include
+)
+
+func (k VarKind) String() string {
+	switch k {
+	case KindPlain:
+		return "plain"
+	case KindNumber:
+		return "number"
+	case KindMacro:
+		return "macro"
+	case KindFile:
+		return "file"
+	case KindBash:
+		return "bash"
+	case KindShellQuote:
+		return "shell_quote"
+	case KindHTML:
+		return "html"
+	case KindInclude:
+		return "include"
+	}
+	return fmt.Sprintf("VarKind(%d)", int(k))
+}
+
+// findNextDollarVar finds the next $name pattern in the string, before is
+// the text preceding s in the template.
 // Returns -1 if no valid $name pattern is found
-func findNextDollarVar(s string) int {
+func findNextDollarVar(before string, s string, opts *CompileOptions) int {
 	for i := 0; i < len(s); i++ {
 		if s[i] == '$' {
 			// Check if this is a ${ pattern (skip it)
 			if i+1 < len(s) && s[i+1] == '{' {
 				continue
 			}
+			// Check if this is a valid $(name) pattern
+			if i+1 < len(s) && s[i+1] == '(' {
+				if name, _ := extractDollarVarName(s[i:], opts); name != "" {
+					return i
+				}
+				continue
+			}
 			// Check if this is a valid $name pattern
-			if i+1 < len(s) && isValidVarStart(s[i+1]) {
-				return i
+			if i+1 < len(s) {
+				if r, _ := utf8.DecodeRuneInString(s[i+1:]); isValidVarStart(r) {
+					if opts.RequireBoundaryBeforeDollar {
+						prev := before
+						if i > 0 {
+							prev = s[:i]
+						}
+						if followsWordChar(prev) {
+							continue
+						}
+					}
+					return i
+				}
 			}
 		}
 	}
@@ -104,7 +295,7 @@ func findNextDollarVar(s string) int {
 
 // extractDollarVarName extracts the variable name from a $name pattern
 // Returns the variable name and the end position (exclusive)
-func extractDollarVarName(s string) (string, int) {
+func extractDollarVarName(s string, opts *CompileOptions) (string, int) {
 	if len(s) == 0 || s[0] != '$' {
 		return "", 0
 	}
@@ -113,11 +304,24 @@ func extractDollarVarName(s string) (string, int) {
 		return "", 0
 	}
 
+	// Explicit boundary: $(name)x -> ${name}x
+	if s[1] == '(' {
+		if len(s) > 2 && s[2] == '(' {
+			return "", 0
+		}
+		name, end := extractDollarVarName("$"+s[2:], opts)
+		if name == "" || end+1 >= len(s) || s[end+1] != ')' {
+			return "", 0
+		}
+		return name, end + 2
+	}
+
 	// Skip the $
 	i := 1
 
 	// Check if first character is valid for variable name
-	if !isValidVarStart(s[i]) {
+	r, size := utf8.DecodeRuneInString(s[i:])
+	if !isValidVarStart(r) {
 		return "", 0
 	}
 
@@ -125,42 +329,258 @@ func extractDollarVarName(s string) (string, int) {
 	start := i
 
 	// Handle macro case: $@timestamp
-	if s[i] == '@' {
+	if r == '@' {
 		i++ // Skip the @
-		// Continue with normal variable name characters
-		for i < len(s) && isValidVarChar(s[i]) {
-			i++
+	}
+	// Continue with normal variable name characters
+	for i < len(s) {
+		r, size = utf8.DecodeRuneInString(s[i:])
+		if (r == '.' && opts.AllowDotInDollarName || r == '-' && opts.AllowHyphenInName) && i+1 < len(s) {
+			// $config.db.host, $name-suffix, a trailing dot or hyphen
+			// still ends the name: $name.
+			if next, _ := utf8.DecodeRuneInString(s[i+1:]); isValidVarChar(next) {
+				i += size
+				continue
+			}
 		}
-	} else {
-		// Normal variable name
-		for i < len(s) && isValidVarChar(s[i]) {
-			i++
+		if !isValidVarChar(r) {
+			// This is a separator, variable name ends here:
+			// $name.s -> ${name}.s,  $name_s -> ${name_s},
+			// underscores always belong to the name: $name_.s -> ${name_}.s
+			break
 		}
+		i += size
 	}
-
-	// Handle separator logic: $name.s -> ${name}.s,  $name_s -> ${name_s}
-	// If we hit a separator that's not underscore, stop
-	if i < len(s) && !isValidVarChar(s[i]) && s[i] != '_' {
-		// This is a separator, variable name ends here
-		return s[start:i], i
+	if s[start:i] == "@" {
+		// a lone $@ is not a macro
+		return "", 0
 	}
 
 	return s[start:i], i
 }
 
+const dollarNumberDirective = ":%d"
+
+// hasDollarNumberDirective reports whether s, the text following a $name,
+// starts with :%d not followed by another name character
+func hasDollarNumberDirective(s string) bool {
+	if !strings.HasPrefix(s, dollarNumberDirective) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(s[len(dollarNumberDirective):])
+	return !isValidVarChar(r)
+}
+
 // isValidVarStart checks if a character is valid for starting a variable name
-func isValidVarStart(c byte) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '@'
+func isValidVarStart(r rune) bool {
+	return r == '_' || r == '@' || unicode.IsLetter(r)
+}
+
+// isValidVarChar checks if a character is valid within a variable name,
+// for ASCII these are letters, digits and underscore
+func isValidVarChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// followsWordChar reports whether s ends with a letter, digit or _
+func followsWordChar(s string) bool {
+	r, size := utf8.DecodeLastRuneInString(s)
+	return size > 0 && isValidVarChar(r)
+}
+
+// findBraceClose returns the index of the } closing a ${ whose content
+// starts s, skipping a quoted name like ${"a}b"} and nested ${...} as used
+// by defaults like ${a?:${b}}. Unbalanced nesting falls back to the first }
+func findBraceClose(s string) int {
+	if name := strings.TrimLeftFunc(s, unicode.IsSpace); strings.HasPrefix(name, `"`) {
+		if end := strings.IndexByte(name[1:], '"'); end >= 0 {
+			skip := len(s) - len(name) + end + 2
+			idx := findBraceClose(s[skip:])
+			if idx < 0 {
+				return -1
+			}
+			return skip + idx
+		}
+	}
+	first := strings.Index(s, close)
+	if first < 0 || !strings.Contains(s[:first], open) {
+		return first
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], open) {
+			depth++
+			i += len(open) - 1
+		} else if s[i] == close[0] {
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return first
+}
+
+// UnclosedBraceError is returned by CompileStrict for a ${ without closing }
+type UnclosedBraceError struct {
+	Offset int // byte offset of ${ in the source template
+}
+
+func (e *UnclosedBraceError) Error() string {
+	return fmt.Sprintf("unclosed variable at offset %d", e.Offset)
+}
+
+// CompileWarning is an issue lenient compilation kept as literal text
+type CompileWarning struct {
+	Offset int    // byte offset in the source template
+	Reason string // e.g. unclosed variable
+}
+
+func (w CompileWarning) String() string {
+	return fmt.Sprintf("offset %d: %s", w.Offset, w.Reason)
+}
+
+// CompileOptions controls how a template is parsed
+type CompileOptions struct {
+	// Strict makes unclosed braces, empty variable names and invalid
+	// directives an error instead of literal text. Unknown directives,
+	// which lenient compilation ignores, are an error as well
+	Strict bool
+	// DisableMacros treats @name as an ordinary, thus invalid, variable
+	// name, so macros are never recognized and stay literal text
+	DisableMacros bool
+	// AllowDotInDollarName makes . part of a $name when followed by
+	// another name character, so $config.db.host is one variable
+	AllowDotInDollarName bool
+	// AllowHyphenInName makes - a name character, so $name-suffix and
+	// ${name-suffix} are one variable. By default - ends a $name
+	AllowHyphenInName bool
+	// RequireBoundaryBeforeDollar only recognizes $name at the start or
+	// after a character other than a letter, digit or _, so a$name stays
+	// literal text. ${name} and $(name) are not affected
+	RequireBoundaryBeforeDollar bool
+	// MaxVars, if positive, limits the number of variable occurrences,
+	// including those of fragment defaults like ${url?:${scheme}://${host}}.
+	// Fragment defaults nest at most 16 levels, with Strict or a limit set
+	// deeper nesting fails with ErrLimitExceeded
+	MaxVars int
+	// MaxLength, if positive, limits the template length in bytes
+	MaxLength int
 }
 
-// isValidVarChar checks if a character is valid within a variable name
-func isValidVarChar(c byte) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+// ErrLimitExceeded is wrapped by the error returned when a template
+// exceeds CompileOptions.MaxVars or MaxLength
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// CompileWithLimits compiles leniently but fails if the template has
+// more than maxVars variable occurrences, to bound work on untrusted input
+func CompileWithLimits(template string, maxVars int) (*Template, error) {
+	return compile(template, &CompileOptions{MaxVars: maxVars})
 }
 
+var defaultCompileOptions = &CompileOptions{}
+var strictCompileOptions = &CompileOptions{Strict: true}
+
+// Compile compiles the template leniently: malformed variables
+// such as unclosed or invalid ${...} are kept as literal text
 func Compile(template string) *Template {
+	t, _ := compile(template, defaultCompileOptions)
+	return t
+}
+
+// CompileStrict is like Compile but returns an error for
+// unclosed braces, empty variable names and invalid or unknown directives
+func CompileStrict(template string) (*Template, error) {
+	return compile(template, strictCompileOptions)
+}
+
+// CompileWithOptions compiles the template with the given options,
+// an error is only returned with opts.Strict
+func CompileWithOptions(template string, opts *CompileOptions) (*Template, error) {
+	if opts == nil {
+		opts = defaultCompileOptions
+	}
+	return compile(template, opts)
+}
+
+// MustCompile is like CompileStrict but panics if the template
+// cannot be compiled, for use in package level var initializers
+func MustCompile(template string) *Template {
+	t, err := CompileStrict(template)
+	if err != nil {
+		panic(fmt.Sprintf("var_template: MustCompile(%q): %v", template, err))
+	}
+	return t
+}
+
+// CompileAll strictly compiles each named template, the
+// errors of all failing templates are aggregated into one error
+func CompileAll(templates map[string]string) (map[string]*Template, error) {
+	return CompileAllWithOptions(templates, strictCompileOptions)
+}
+
+// CompileAllWithOptions is like CompileAll but compiles each template
+// with the given options, nil options compile leniently like Compile
+func CompileAllWithOptions(templates map[string]string, opts *CompileOptions) (map[string]*Template, error) {
+	if opts == nil {
+		opts = defaultCompileOptions
+	}
+	compiled := make(map[string]*Template, len(templates))
+	var errMsgs []string
+	for _, name := range sortedKeys(templates) {
+		t, err := compile(templates[name], opts)
+		if err != nil {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		compiled[name] = t
+	}
+	if len(errMsgs) > 0 {
+		return nil, fmt.Errorf("compile templates: %s", strings.Join(errMsgs, "; "))
+	}
+	return compiled, nil
+}
+
+func compile(template string, opts *CompileOptions) (*Template, error) {
+	t := &Template{}
+	if err := t.compile(template, opts); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// maxDefaultDepth bounds nested fragment defaults like ${a?:${b?:${c}}}
+const maxDefaultDepth = 16
+
+// compileState is shared by a compile and the nested compiles of its
+// fragment defaults, so limits apply to the template as a whole
+type compileState struct {
+	numVars int // variable occurrences, for CompileOptions.MaxVars
+	depth   int // nesting of fragment defaults
+}
+
+// compile parses template into c, reusing the backing arrays of c's slices
+func (c *Template) compile(template string, opts *CompileOptions) error {
+	return c.compileWith(template, opts, &compileState{})
+}
+
+func (c *Template) compileWith(template string, opts *CompileOptions, st *compileState) error {
+	c.compileOpts = *opts
+	if opts.MaxLength > 0 && len(template) > opts.MaxLength {
+		return fmt.Errorf("template length %d exceeds %d: %w", len(template), opts.MaxLength, ErrLimitExceeded)
+	}
+	c.warnings = c.warnings[:0]
+	c.varErrors = nil
+	if strings.IndexByte(template, '$') < 0 {
+		// no variables nor escapes, e.g. a log prefix
+		c.template = template
+		c.varPositions = c.varPositions[:0]
+		c.vars = c.vars[:0]
+		return nil
+	}
 	// find all variables and positions
-	var positions []*varAndPosition
+	positions := c.varPositions[:0]
+	var dollarEscapes []int
 	varMap := make(map[string]bool)
 	s := template
 	i := 0
@@ -169,7 +589,7 @@ func Compile(template string) *Template {
 	for s != "" {
 		// Look for both ${} and $ patterns
 		braceOpenIdx := strings.Index(s, open)
-		dollarIdx := findNextDollarVar(s)
+		dollarIdx := findNextDollarVar(template[:i], s, opts)
 
 		// Determine which pattern comes first
 		var nextIdx int
@@ -200,6 +620,20 @@ func Compile(template string) *Template {
 			s = s[nextIdx+1:]
 			continue
 		}
+		// $${x}, $$name: like in make, each $$ of a run of $ ending in a
+		// variable is a literal $, and the variable is literal text when
+		// the run is even. A run not ending in a variable is kept as is.
+		// An escaped \$ does not belong to the run
+		dollarRun := 0
+		for k := i + nextIdx - 1; k >= 0 && template[k] == '$'; k-- {
+			if k > 0 && template[k-1] == '\\' {
+				break
+			}
+			dollarRun++
+		}
+		escaped := dollarRun%2 == 1
+		// an escaped variable does not count toward the limits
+		saved := *st
 
 		var v *varAndPosition
 		var endIdx int
@@ -207,47 +641,115 @@ func Compile(template string) *Template {
 		if isBracePattern {
 			// Handle ${name} pattern
 			openIdxEnd := nextIdx + len(open)
-			closeIdx := strings.Index(s[openIdxEnd:], close)
+			closeIdx := findBraceClose(s[openIdxEnd:])
 			if closeIdx < 0 {
+				if escaped {
+					i += openIdxEnd
+					s = s[openIdxEnd:]
+					continue
+				}
+				if opts.Strict {
+					return &UnclosedBraceError{Offset: i + nextIdx}
+				}
+				c.warnings = append(c.warnings, CompileWarning{Offset: i + nextIdx, Reason: "unclosed variable"})
 				i += openIdxEnd
 				s = s[openIdxEnd:]
 				continue
 			}
 			closeIdx += openIdxEnd
-			varName := strings.TrimSpace(s[openIdxEnd:closeIdx])
+			varName := trimVarBody(s[openIdxEnd:closeIdx])
 
-			v = parseVarName(varName)
-			if v.varName == "" {
+			var err error
+			v, err = parseVarSpec(varName, opts, st)
+			if err == nil && v.varName == "" {
+				err = fmt.Errorf("empty variable name")
+			}
+			if err != nil && escaped {
+				*st = saved
+				i += closeIdx + len(close)
+				s = s[closeIdx+len(close):]
+				continue
+			}
+			if err != nil {
+				// limits are errors if any are asked for, a plain lenient
+				// compile keeps a too deeply nested default as literal text
+				if opts.Strict || errors.Is(err, ErrLimitExceeded) && (opts.MaxVars > 0 || opts.MaxLength > 0) {
+					return fmt.Errorf("invalid variable %s%s%s at offset %d: %w", open, varName, close, i+nextIdx, err)
+				}
+				c.warnings = append(c.warnings, CompileWarning{
+					Offset: i + nextIdx,
+					Reason: fmt.Sprintf("invalid variable %s%s%s: %v", open, varName, close, err),
+				})
+				if c.varErrors == nil {
+					c.varErrors = make(map[string]error)
+				}
+				c.varErrors[s[nextIdx:closeIdx+len(close)]] = err
 				i += closeIdx + len(close)
 				s = s[closeIdx+len(close):]
 				continue
 			}
 
+			v.varInitContent = s[openIdxEnd:closeIdx]
 			v.open = i + nextIdx
 			v.close = i + closeIdx
 			endIdx = closeIdx + len(close)
 		} else {
 			// Handle $name pattern
-			varName, varEnd := extractDollarVarName(s[nextIdx:])
+			varName, varEnd := extractDollarVarName(s[nextIdx:], opts)
 			if varName == "" {
 				i += nextIdx + 1
 				s = s[nextIdx+1:]
 				continue
 			}
 
-			v = parseVarName(varName)
-			if v.varName == "" {
+			spec := varName
+			if hasDollarNumberDirective(s[nextIdx+varEnd:]) && !strings.HasPrefix(varName, "@") {
+				// $age:%d, the only directive the dollar syntax takes,
+				// any other colon like in $host:$port is literal text
+				spec += dollarNumberDirective
+				varEnd += len(dollarNumberDirective)
+			}
+
+			var err error
+			v, err = parseVarSpec(spec, opts, st)
+			if err != nil || v.varName == "" {
 				i += nextIdx + 1
 				s = s[nextIdx+1:]
 				continue
 			}
+			if !v.isMacro && strings.Contains(varName, ".") {
+				// only with AllowDotInDollarName, the dotted name is kept verbatim
+				v.varName = varName
+			}
 
+			v.varInitContent = spec
 			v.open = i + nextIdx
 			v.close = i + nextIdx + varEnd - 1
 			endIdx = nextIdx + varEnd
 		}
 
+		if dollarRun > 0 {
+			// drop the first $ of each pair
+			start := i + nextIdx - dollarRun
+			for k := 0; k < (dollarRun+1)/2; k++ {
+				dollarEscapes = append(dollarEscapes, start+2*k)
+			}
+		}
+		if escaped {
+			*st = saved
+			i += endIdx
+			s = s[endIdx:]
+			continue
+		}
+
+		if opts.MaxVars > 0 && st.numVars >= opts.MaxVars {
+			return fmt.Errorf("more than %d variables: %w", opts.MaxVars, ErrLimitExceeded)
+		}
+		st.numVars++
 		varMap[v.varName] = true
+		for _, name := range v.refs() {
+			varMap[name] = true
+		}
 		index++
 		v.index = index
 		positions = append(positions, v)
@@ -256,123 +758,245 @@ func Compile(template string) *Template {
 	}
 
 	// Post-process to handle escaped sequences and adjust positions
-	processedTemplate, adjustedPositions := processEscapesAndAdjustPositions(template, positions)
-
-	return &Template{
-		template:     processedTemplate,
-		varPositions: adjustedPositions,
-		vars:         getVars(varMap),
-	}
+	c.template = processEscapesAndAdjustPositions(template, positions, dollarEscapes)
+	c.varPositions = positions
+	c.vars = appendVars(c.vars[:0], varMap)
+	return nil
 }
 
 // processEscapesAndAdjustPositions removes backslashes from escaped variable patterns
-// and adjusts variable positions accordingly
-func processEscapesAndAdjustPositions(template string, positions []*varAndPosition) (string, []*varAndPosition) {
-	result := template
-	adjustedPositions := make([]*varAndPosition, len(positions))
-
-	// Copy positions
-	for i, pos := range positions {
-		adjustedPositions[i] = pos.clone()
-	}
-
-	// Process escapes and adjust positions
-	adjustment := 0
-	for i := 0; i < len(result); i++ {
-		if i > 0 && result[i-1] == '\\' && (result[i] == '$') {
-			// Remove the backslash
-			result = result[:i-1] + result[i:]
-			i-- // Adjust index after removal
-			adjustment++
-
-			// Adjust all positions that come after this escape
-			for _, pos := range adjustedPositions {
-				if pos.open > i {
-					pos.open--
-				}
-				if pos.close > i {
-					pos.close--
-				}
-			}
+// and the first $ of each $$ escape at the given offsets, and adjusts the freshly
+// parsed variable positions in place. The text of variables is kept as written
+func processEscapesAndAdjustPositions(template string, positions []*varAndPosition, dollarEscapes []int) string {
+	// offsets of the bytes to remove, in ascending order
+	var removed []int
+	k := 0
+	p := 0 // next variable, whose span is kept as written
+	for i := 0; i < len(template); i++ {
+		if p < len(positions) && i == positions[p].open {
+			i = getVarEndPos(template, positions[p]) - 1
+			p++
+			continue
 		}
+		if k < len(dollarEscapes) && dollarEscapes[k] == i {
+			k++
+			removed = append(removed, i)
+		} else if template[i] == '\\' && i+1 < len(template) && template[i+1] == '$' {
+			removed = append(removed, i)
+		}
+	}
+	if len(removed) == 0 {
+		return template
+	}
+
+	var b strings.Builder
+	b.Grow(len(template) - len(removed))
+	last := 0
+	for _, r := range removed {
+		b.WriteString(template[last:r])
+		last = r + 1
+	}
+	b.WriteString(template[last:])
+
+	// Adjust all positions that come after the removed bytes
+	for _, pos := range positions {
+		pos.open -= sort.SearchInts(removed, pos.open)
+		pos.close -= sort.SearchInts(removed, pos.close)
+	}
+	return b.String()
+}
+
+// Unescape removes the escapes Compile recognizes outside of variables,
+// which are kept as written: \$ becomes $, and $$ before a variable becomes
+// $, while ${a?:\$x} is unchanged. There is no backslash escape for a
+// backslash, \\${a} becomes \${a}
+func Unescape(s string) string {
+	if strings.IndexByte(s, '$') < 0 {
+		return s
+	}
+	t := &Template{}
+	// lenient compile never fails
+	t.compile(s, defaultCompileOptions)
+	return t.template
+}
+
+// VarSpec is the parsed body of a single ${...} variable
+type VarSpec struct {
+	Name       string
+	Required   bool
+	HasDefault bool
+	Default    string
+	Directives []string
+	Macro      bool
+	// Conditional is set for ${?name::text}, Text is the text
+	// rendered before the value
+	Conditional bool
+	Text        string
+}
+
+// ParseSpec parses the body of a ${...} variable without its delimiters,
+// like "port!?:8080:%d", e.g. to validate it while it is being typed.
+// Invalid or unknown directives and empty names are errors, as in CompileStrict
+func ParseSpec(raw string) (VarSpec, error) {
+	v, err := parseVarSpec(trimVarBody(raw), strictCompileOptions, &compileState{})
+	if err == nil && v.varName == "" {
+		err = fmt.Errorf("empty variable name")
+	}
+	if err != nil {
+		return VarSpec{}, err
 	}
+	return VarSpec{
+		Name:        v.varName,
+		Required:    v.required,
+		HasDefault:  v.hasDefaultValue,
+		Default:     v.defaultValue,
+		Directives:  v.directives,
+		Macro:       v.isMacro,
+		Conditional: v.isConditional,
+		Text:        v.conditionalText,
+	}, nil
+}
+
+// trimVarBody trims the body of a ${...} variable, trailing whitespace
+// is kept if it may belong to a default value like ${x?:  spaced  }
+func trimVarBody(s string) string {
+	if strings.Contains(s, "?:") || endsWithSpacedArg(s) {
+		return strings.TrimLeftFunc(s, unicode.IsSpace)
+	}
+	return strings.TrimSpace(s)
+}
 
-	return result, adjustedPositions
+// endsWithSpacedArg reports whether the last directive of s is
+// :join:SEP:WITH or :replace:FROM:TO, whose last argument may end with
+// whitespace like in ${tags:join:,:, } or ${s:replace:-: }
+func endsWithSpacedArg(s string) bool {
+	for _, d := range []string{":join:", ":replace:"} {
+		idx := strings.LastIndex(s, d)
+		if idx >= 0 && len(splitUnescapedColon(s[idx+len(d):])) == 2 {
+			return true
+		}
+	}
+	return false
 }
 
 func parseVarName(varName string) *varAndPosition {
-	// New approach: split by delimiters and recognize directives
-	var actualVarName string
-	var required bool
-	var isNumber bool
-	var hasDefaultValue bool
-	var defaultValue string
-	var repMode = repeatMode_Same
-	var isMacro bool
-	var isFile bool
-	var isBash bool
-	var isShellQuote bool
+	v, err := parseVarSpec(varName, defaultCompileOptions, &compileState{})
+	if err != nil {
+		// Return an empty varAndPosition for invalid variables
+		return &varAndPosition{
+			raw:     varName,
+			varName: "",
+		}
+	}
+	return v
+}
+
+// parseVarSpec is like parseVarName but reports why a definition is invalid
+func parseVarSpec(varName string, opts *CompileOptions, st *compileState) (*varAndPosition, error) {
+	v := &varAndPosition{
+		raw:        varName,
+		repeatMode: repeatMode_Same,
+	}
 
 	// Handle macro prefix
-	if strings.HasPrefix(varName, "@") {
-		isMacro = true
-		actualVarName = varName // Keep the @ prefix for macros
-	} else {
-		// Parse using the new approach
-		var err error
-		actualVarName, required, hasDefaultValue, defaultValue, isNumber, repMode, isFile, isBash, isShellQuote, err = parseVariableDefinition(varName)
-		if err != nil {
-			// Return an empty varAndPosition for invalid variables
-			return &varAndPosition{
-				raw:     varName,
-				varName: "",
-			}
+	if strings.HasPrefix(varName, "@") && !opts.DisableMacros {
+		v.isMacro = true
+		v.varName = varName // Keep the @ prefix for macros
+		// ${@macro?:fallback} is used when the macro is unknown
+		if idx := strings.Index(varName, "?:"); idx != -1 {
+			v.varName = varName[:idx]
+			v.hasDefaultValue = true
+			v.defaultValue = varName[idx+2:]
+		}
+	} else if strings.HasPrefix(varName, `\@`) {
+		// ${\@type}: a literal @ starting an ordinary variable name
+		if err := parseVariableDefinition(varName[2:], v, opts, st); err != nil {
+			return nil, err
 		}
+		if v.varName != "" {
+			v.varName = "@" + strings.TrimSpace(v.varName)
+		}
+	} else if strings.HasPrefix(varName, "?") {
+		v.isConditional = true
+		name := varName[1:]
+		if idx := strings.Index(name, "::"); idx != -1 {
+			v.conditionalText = name[idx+2:]
+			name = name[:idx]
+		}
+		v.varName, _ = parseVariableNameAndRequired(name, opts.AllowHyphenInName)
+	} else if err := parseVariableDefinition(varName, v, opts, st); err != nil {
+		return nil, err
 	}
-
-	return &varAndPosition{
-		raw:             varName,
-		varName:         strings.TrimSpace(actualVarName),
-		isNumber:        isNumber,
-		repeatMode:      repMode,
-		hasDefaultValue: hasDefaultValue,
-		defaultValue:    defaultValue,
-		required:        required,
-		isMacro:         isMacro,
-		// New directive fields
-		isFile:       isFile,
-		isBash:       isBash,
-		isShellQuote: isShellQuote,
+	if !v.isQuoted {
+		v.varName = strings.TrimSpace(v.varName)
 	}
+	return v, nil
 }
 
-// parseVariableDefinition parses a variable definition using the new approach
-func parseVariableDefinition(varName string) (name string, required bool, hasDefault bool, defaultVal string, isNumber bool, repMode repeatMode, isFile bool, isBash bool, isShellQuote bool, err error) {
-	repMode = repeatMode_Same
+// parseVariableDefinition parses a variable definition, filling name, flags and directives into v
+func parseVariableDefinition(varName string, v *varAndPosition, opts *CompileOptions, st *compileState) error {
+	// Quoted name: ${"user.name"}, directives follow the closing quote
+	if strings.HasPrefix(varName, `"`) {
+		end := strings.Index(varName[1:], `"`)
+		if end < 0 {
+			return fmt.Errorf("unclosed quoted name: %s", varName)
+		}
+		quotedName := varName[1 : end+1]
+		if err := parseVariableDefinition(varName[end+2:], v, opts, st); err != nil {
+			return err
+		}
+		if v.varName != "" {
+			return fmt.Errorf("unexpected text after quoted name: %s", varName)
+		}
+		v.varName = quotedName
+		v.isQuoted = true
+		return nil
+	}
 
 	// Special handling for bash directive - check if it ends with :bash
-	if strings.HasSuffix(varName, ":bash") {
-		// Check for multiple directives first
-		beforeBash := varName[:len(varName)-5] // Remove ":bash"
-
+	// An escaped \:bash belongs to the default value instead
+	if strings.HasSuffix(varName, ":bash") && !strings.HasSuffix(varName, `\:bash`) {
 		// For bash directive, the variable name is the command (everything before :bash)
-		name = beforeBash
-		isBash = true
-		return
+		v.varName = varName[:len(varName)-5] // Remove ":bash"
+		v.isBash = true
+		v.addDirective("bash")
+		return nil
 	}
-	if strings.HasSuffix(varName, ":file") {
-		// Check for multiple directives first
-		beforeFile := varName[:len(varName)-5] // Remove ":file"
-		name = beforeFile
-		isFile = true
-		return
+	if strings.HasSuffix(varName, ":file") && !strings.HasSuffix(varName, `\:file`) {
+		v.varName = varName[:len(varName)-5] // Remove ":file"
+		v.isFile = true
+		v.addDirective("file")
+		return nil
+	}
+	if strings.HasSuffix(varName, ":include") && !strings.HasSuffix(varName, `\:include`) {
+		v.varName = varName[:len(varName)-len(":include")]
+		v.isInclude = true
+		v.addDirective("include")
+		return nil
+	}
+
+	// Environment fallback: ${port:env:PORT?:8080}, tried after vars and before the default
+	if idx := strings.Index(varName, ":env:"); idx != -1 {
+		if defIdx := strings.Index(varName, "?:"); defIdx == -1 || idx < defIdx {
+			rest := varName[idx+len(":env:"):]
+			end := len(rest)
+			if j := strings.IndexAny(rest, ":?"); j != -1 {
+				end = j
+			}
+			if end == 0 {
+				return fmt.Errorf("missing environment variable name: %s", varName)
+			}
+			v.envName = rest[:end]
+			v.addDirective("env:" + v.envName)
+			varName = varName[:idx] + rest[end:]
+		}
 	}
 
 	// Step 1: Find the variable name (everything before the first ?: or :)
 	var nameEnd int
 	if idx := strings.Index(varName, "?:"); idx != -1 {
 		nameEnd = idx
-		hasDefault = true
+		v.hasDefaultValue = true
 	} else if idx := strings.Index(varName, ":"); idx != -1 {
 		nameEnd = idx
 	} else {
@@ -380,81 +1004,288 @@ func parseVariableDefinition(varName string) (name string, required bool, hasDef
 	}
 
 	// Extract variable name and check for required flag
-	namePart := varName[:nameEnd]
-	name, required = parseVariableNameAndRequired(namePart)
+	v.varName, v.required = parseVariableNameAndRequired(varName[:nameEnd], opts.AllowHyphenInName)
 
 	// Step 2: Process the rest of the string
 	remainder := varName[nameEnd:]
 
-	if hasDefault {
+	if v.hasDefaultValue {
 		// We have a default value, extract it
 		remainder = remainder[2:] // Skip "?:"
-		defaultVal, remainder = extractDefaultValue(remainder)
+		v.defaultValue, remainder = extractDefaultValue(remainder)
+		v.defaultExpr = parseDefaultExpr(v.defaultValue)
+		if v.defaultExpr == nil && strings.Contains(v.defaultValue, open) {
+			// the default is a template fragment: ${url?:${scheme}://${host}}
+			if st.depth >= maxDefaultDepth {
+				return fmt.Errorf("defaults nested more than %d levels: %w", maxDefaultDepth, ErrLimitExceeded)
+			}
+			t := &Template{}
+			st.depth++
+			err := t.compileWith(v.defaultValue, opts, st)
+			st.depth--
+			if err != nil {
+				return fmt.Errorf("invalid default %s: %w", v.defaultValue, err)
+			}
+			v.defaultTemplate = t
+		}
 	}
 
 	// Step 3: Process any remaining directives
+	if !endsWithSpacedArg(remainder) {
+		remainder = strings.TrimRightFunc(remainder, unicode.IsSpace)
+	}
 	if remainder != "" && strings.HasPrefix(remainder, ":") {
 		remainder = remainder[1:] // Skip ":"
 
+		// Directives taking colon separated arguments
+		if handled, err := parseArgDirective(remainder, v); handled || err != nil {
+			return err
+		}
+
 		// Check for multiple directives (should be an error)
 		if strings.Contains(remainder, ":") {
-			return "", false, false, "", false, repeatMode_Same, false, false, false, fmt.Errorf("multiple directives not allowed: %s", remainder)
+			return fmt.Errorf("multiple directives not allowed: %s", remainder)
 		}
 
 		// Check for directives
-		if remainder == "%d" {
-			isNumber = true
-		} else if remainder == "+" {
-			repMode = repeatMode_Uniq
-		} else if remainder == "*" {
-			repMode = repeatMode_Any
-		} else if remainder == "shell_quote" {
-			isShellQuote = true
+		if isDirective(remainder) {
+			v.addDirective(remainder)
+		} else if opts.Strict {
+			return fmt.Errorf("unknown directive: %s", remainder)
+		}
+		// repeat modes may carry a list separator: ${items:+;}
+		if isRepeatSeparator(remainder) {
+			v.listSeparator = remainder[1:]
+			remainder = remainder[:1]
+		}
+		switch remainder {
+		case "%d":
+			v.isNumber = true
+		case "+", "uniq":
+			v.repeatMode = repeatMode_Uniq
+		case "*", "any":
+			v.repeatMode = repeatMode_Any
+		case "shell_quote":
+			v.isShellQuote = true
+		case "secret":
+			v.isSecret = true
+		case "html":
+			v.isHTML = true
+		case "urlencode":
+			v.isURLEncode = true
+		case "once":
+			v.isOnce = true
+		}
+	}
+
+	return nil
+}
+
+// parseArgDirective parses a directive with colon separated arguments,
+// reports false if remainder is not such a directive
+func parseArgDirective(remainder string, v *varAndPosition) (bool, error) {
+	switch {
+	case strings.HasPrefix(remainder, "clamp:"):
+		// clamp:MIN:MAX, optionally followed by :%d
+		args := strings.Split(remainder, ":")
+		if len(args) == 4 && args[3] == "%d" {
+			args = args[:3]
+		}
+		if len(args) != 3 {
+			return true, fmt.Errorf("invalid clamp directive, want clamp:MIN:MAX: %s", remainder)
+		}
+		min, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return true, fmt.Errorf("invalid clamp min: %s", args[1])
+		}
+		max, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return true, fmt.Errorf("invalid clamp max: %s", args[2])
+		}
+		if min > max {
+			return true, fmt.Errorf("clamp min %d is greater than max %d", min, max)
+		}
+		v.hasClamp = true
+		v.clampMin, v.clampMax = min, max
+		v.isNumber = true
+		v.addDirective(strings.Join(args, ":"))
+		if strings.HasSuffix(remainder, ":%d") {
+			v.addDirective("%d")
+		}
+		return true, nil
+	case strings.HasPrefix(remainder, "idx:"):
+		// idx:N selects the N-th list item, negative N counts from the end
+		idx, err := strconv.Atoi(remainder[len("idx:"):])
+		if err != nil {
+			return true, fmt.Errorf("invalid idx directive, want idx:N: %s", remainder)
+		}
+		v.hasIndex = true
+		v.listIndex = idx
+		v.addDirective(remainder)
+		return true, nil
+	case isGatedTransform(remainder):
+		// shell_quote_if:VAR, html_if:VAR, urlencode_if:VAR
+		idx := strings.Index(remainder, "_if:")
+		gate := remainder[idx+len("_if:"):]
+		if name, _ := parseVariableNameAndRequired(gate, false); name == "" || name != gate {
+			return true, fmt.Errorf("invalid gate variable in %s", remainder)
+		}
+		switch remainder[:idx] {
+		case "shell_quote":
+			v.isShellQuote = true
+		case "html":
+			v.isHTML = true
+		case "urlencode":
+			v.isURLEncode = true
+		}
+		v.transformIf = gate
+		v.addDirective(remainder)
+		return true, nil
+	case strings.HasPrefix(remainder, "replace:"):
+		// replace:FROM:TO, \: is a literal colon in FROM and TO
+		args := splitUnescapedColon(remainder[len("replace:"):])
+		if len(args) != 2 {
+			return true, fmt.Errorf("invalid replace directive, want replace:FROM:TO: %s", remainder)
+		}
+		v.hasReplace = true
+		v.replaceFrom, v.replaceTo = args[0], args[1]
+		v.addDirective(remainder)
+		return true, nil
+	case strings.HasPrefix(remainder, "join:"):
+		// join:SEP:WITH, \: is a literal colon in SEP and WITH
+		args := splitUnescapedColon(remainder[len("join:"):])
+		if len(args) != 2 || args[0] == "" {
+			return true, fmt.Errorf("invalid join directive, want join:SEP:WITH: %s", remainder)
+		}
+		v.hasJoin = true
+		v.joinSep, v.joinWith = args[0], args[1]
+		v.addDirective(remainder)
+		return true, nil
+	}
+	return false, nil
+}
+
+// isGatedTransform reports whether s is a transform directive gated by
+// another variable, like shell_quote_if:quoting
+func isGatedTransform(s string) bool {
+	for _, prefix := range []string{"shell_quote_if:", "html_if:", "urlencode_if:"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
 		}
 	}
+	return false
+}
 
-	return
+// splitUnescapedColon splits s on colons not preceded by a backslash,
+// the backslash of an escaped colon is dropped
+func splitUnescapedColon(s string) []string {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == ':' {
+			b.WriteByte(':')
+			i++
+			continue
+		}
+		if s[i] == ':' {
+			parts = append(parts, b.String())
+			b.Reset()
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return append(parts, b.String())
 }
 
 // parseVariableNameAndRequired extracts variable name and required flag, handling invalid characters
-func parseVariableNameAndRequired(segment string) (string, bool) {
+func parseVariableNameAndRequired(segment string, allowHyphen bool) (string, bool) {
 	segment = strings.TrimSpace(segment)
 
-	// Find the actual variable name (alphanumeric + underscore)
-	var nameBytes []byte
+	// Find the actual variable name (letters, digits and underscore)
+	nameEnd := len(segment)
 	var foundRequired bool
 
 	for i, r := range segment {
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
-			nameBytes = append(nameBytes, segment[i])
-		} else if r == '!' {
+		if isValidVarChar(r) || r == '-' && allowHyphen && i > 0 {
+			continue
+		}
+		nameEnd = i
+		if r == '!' {
 			foundRequired = true
-			// Stop processing after finding the required flag
-			break
-		} else {
-			// Invalid character, stop processing
-			break
 		}
+		// Stop processing after the required flag or an invalid character
+		break
 	}
 
-	return string(nameBytes), foundRequired
+	return segment[:nameEnd], foundRequired
 }
 
-// extractDefaultValue extracts the default value from the remainder, stopping at directive markers
+// extractDefaultValue extracts the default value from the remainder, stopping at directive markers.
+// An escaped colon \: is a literal colon that never starts a directive
 func extractDefaultValue(remainder string) (defaultVal string, remaining string) {
+	// b is only used once an escaped colon is found, otherwise
+	// the default is a substring of remainder
+	var b strings.Builder
+	last := 0
+	depth := 0 // nesting of ${...} fragments, whose colons are not markers
 	// Look for the next directive marker
 	for i := 0; i < len(remainder); i++ {
+		if strings.HasPrefix(remainder[i:], open) {
+			depth++
+			i += len(open) - 1
+			continue
+		}
+		if depth > 0 {
+			if remainder[i] == close[0] {
+				depth--
+			}
+			continue
+		}
+		if remainder[i] == '\\' && i+1 < len(remainder) && remainder[i+1] == ':' {
+			b.WriteString(remainder[last:i])
+			last = i + 1 // keep the colon
+			i++
+			continue
+		}
 		if remainder[i] == ':' {
-			// Check if this is followed by a directive
-			if i+1 < len(remainder) {
-				next := remainder[i+1:]
-				if next == "%d" || next == "+" || next == "*" || next == "file" || next == "bash" || next == "shell_quote" {
-					// This is a directive marker
+			// Check if this is followed by a directive, a repeat separator
+			// like :+0800 or :*.go is part of the default instead
+			if next := strings.TrimRightFunc(remainder[i+1:], unicode.IsSpace); next != "" && isDirective(next) && !isRepeatSeparator(next) {
+				// This is a directive marker
+				if last == 0 {
 					return remainder[:i], remainder[i:]
 				}
+				b.WriteString(remainder[last:i])
+				return b.String(), remainder[i:]
 			}
 		}
 	}
 	// No directive found, the entire remainder is the default value
-	return remainder, ""
+	if last == 0 {
+		return remainder, ""
+	}
+	b.WriteString(remainder[last:])
+	return b.String(), ""
+}
+
+// isDirective reports whether s is a directive following a default value
+func isDirective(s string) bool {
+	switch s {
+	case "%d", "+", "*", "uniq", "any", "file", "bash", "shell_quote", "secret", "html", "urlencode", "once":
+		return true
+	}
+	if strings.HasPrefix(s, "clamp:") || strings.HasPrefix(s, "idx:") || strings.HasPrefix(s, "replace:") || strings.HasPrefix(s, "join:") || isGatedTransform(s) {
+		return true
+	}
+	return isRepeatSeparator(s)
+}
+
+// isRepeatSeparator reports whether s is a repeat mode with a list separator
+// of a single byte other than a letter, digit or colon, like +; or *|
+func isRepeatSeparator(s string) bool {
+	if len(s) != 2 || s[0] != '+' && s[0] != '*' {
+		return false
+	}
+	c := s[1]
+	return c != ':' && c < utf8.RuneSelf && !unicode.IsLetter(rune(c)) && !unicode.IsDigit(rune(c)) && !unicode.IsSpace(rune(c))
 }
@@ -0,0 +1,137 @@
+package var_template
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultExpr is a default value computed from other variables at apply time:
+// a reference like ${base}, or a single + or * between two operands
+// like ${base}*2, evaluated only when both operands are integers.
+type defaultExpr struct {
+	left  exprOperand
+	op    byte // '+', '*', or 0 for a plain reference
+	right exprOperand
+}
+
+// exprOperand is either a variable reference or an integer literal
+type exprOperand struct {
+	name string // referenced variable, empty for a literal
+	num  int64
+}
+
+// parseDefaultExpr parses a default value as an expression, returns nil
+// when it does not reference any variable so it stays a literal default
+func parseDefaultExpr(s string) *defaultExpr {
+	if !strings.Contains(s, "$") {
+		return nil
+	}
+	if left, ok := parseExprOperand(s); ok && left.name != "" {
+		return &defaultExpr{left: left}
+	}
+	idx := strings.IndexAny(s, "+*")
+	if idx < 0 {
+		return nil
+	}
+	left, ok := parseExprOperand(s[:idx])
+	if !ok {
+		return nil
+	}
+	right, ok := parseExprOperand(s[idx+1:])
+	if !ok {
+		return nil
+	}
+	return &defaultExpr{left: left, op: s[idx], right: right}
+}
+
+// parseExprOperand parses ${name}, $name or an integer
+func parseExprOperand(s string) (exprOperand, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, open) && strings.HasSuffix(s, close) {
+		name := strings.TrimSpace(s[len(open) : len(s)-len(close)])
+		if !isPlainVarName(name) {
+			return exprOperand{}, false
+		}
+		return exprOperand{name: name}, true
+	}
+	if strings.HasPrefix(s, "$") {
+		name, end := extractDollarVarName(s, defaultCompileOptions)
+		if end != len(s) || !isPlainVarName(name) {
+			return exprOperand{}, false
+		}
+		return exprOperand{name: name}, true
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return exprOperand{}, false
+	}
+	return exprOperand{num: n}, true
+}
+
+// isPlainVarName reports whether name is a non-macro variable name
+func isPlainVarName(name string) bool {
+	if name == "" || name[0] == '@' {
+		return false
+	}
+	for i, r := range name {
+		if i == 0 && !isValidVarStart(r) || i > 0 && !isValidVarChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// eval resolves the expression with lookup, which returns the value of a
+// referenced variable. Returns false when a referenced variable is missing
+func (e *defaultExpr) eval(lookup func(name string) (string, bool)) (string, bool, error) {
+	if e.op == 0 {
+		val, ok := lookup(e.left.name)
+		return val, ok, nil
+	}
+	left, ok, err := e.left.number(lookup)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	right, ok, err := e.right.number(lookup)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	if e.op == '+' {
+		return strconv.FormatInt(left+right, 10), true, nil
+	}
+	return strconv.FormatInt(left*right, 10), true, nil
+}
+
+// validate runs the validator of each referenced variable on its value
+func (e *defaultExpr) validate(lookup func(name string) (string, bool), validators map[string]func(value string) error) error {
+	for _, o := range []exprOperand{e.left, e.right} {
+		validate := validators[o.name]
+		if o.name == "" || validate == nil {
+			continue
+		}
+		if val, ok := lookup(o.name); ok {
+			if err := validate(val); err != nil {
+				return fmt.Errorf("variable %s: %w", o.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// number resolves the operand as an integer, the error leaves out the
+// value, which may be secret
+func (o exprOperand) number(lookup func(name string) (string, bool)) (int64, bool, error) {
+	if o.name == "" {
+		return o.num, true, nil
+	}
+	val, ok := lookup(o.name)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("%s is not a number", o.name)
+	}
+	return n, true, nil
+}
@@ -0,0 +1,104 @@
+package var_template
+
+import "sort"
+
+// TemplateDiff is the structural difference between two templates
+type TemplateDiff struct {
+	Added   []string    // variables only in b, sorted
+	Removed []string    // variables only in a, sorted
+	Changed []VarChange // variables in both with different metadata, sorted by name
+}
+
+// VarChange describes a variable whose metadata differs between two templates.
+// Metadata are its directives plus "required" and "default=VALUE",
+// collected over all occurrences of the variable
+type VarChange struct {
+	Name   string
+	Before []string
+	After  []string
+}
+
+// Empty reports whether the two templates use the same variables the same way
+func (d TemplateDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff compares the variables of a and b
+func Diff(a, b *Template) TemplateDiff {
+	before := varMetadata(a)
+	after := varMetadata(b)
+
+	var d TemplateDiff
+	for _, name := range sortedMetaKeys(before) {
+		afterMeta, ok := after[name]
+		if !ok {
+			d.Removed = append(d.Removed, name)
+			continue
+		}
+		if !equalStrings(before[name], afterMeta) {
+			d.Changed = append(d.Changed, VarChange{Name: name, Before: before[name], After: afterMeta})
+		}
+	}
+	for _, name := range sortedMetaKeys(after) {
+		if _, ok := before[name]; !ok {
+			d.Added = append(d.Added, name)
+		}
+	}
+	return d
+}
+
+// varMetadata returns the sorted, deduplicated metadata of each variable
+func varMetadata(t *Template) map[string][]string {
+	sets := make(map[string]map[string]bool)
+	for _, vr := range t.varPositions {
+		set := sets[vr.varName]
+		if set == nil {
+			set = make(map[string]bool)
+			sets[vr.varName] = set
+		}
+		for _, d := range vr.directives {
+			set[d] = true
+		}
+		if vr.required {
+			set["required"] = true
+		}
+		if vr.hasDefaultValue {
+			if vr.isSecret {
+				set["default=***"] = true
+			} else {
+				set["default="+vr.defaultValue] = true
+			}
+		}
+	}
+	meta := make(map[string][]string, len(sets))
+	for name, set := range sets {
+		list := make([]string, 0, len(set))
+		for k := range set {
+			list = append(list, k)
+		}
+		sort.Strings(list)
+		meta[name] = list
+	}
+	return meta
+}
+
+func sortedMetaKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -195,6 +195,24 @@ func TestComplexDefaultValues(t *testing.T) {
 			vars:     map[string]string{},
 			want:     "Value: ",
 		},
+		{
+			name:     "default with escaped colon before %d",
+			template: "Format: ${format?:value\\:%d}",
+			vars:     map[string]string{},
+			want:     "Format: value:%d",
+		},
+		{
+			name:     "default that is an escaped :bash",
+			template: "Shell: ${shell?:\\:bash}",
+			vars:     map[string]string{},
+			want:     "Shell: :bash",
+		},
+		{
+			name:     "default with escaped colon and directive",
+			template: "Port: ${port?:80\\:81:secret}",
+			vars:     map[string]string{},
+			want:     "Port: 80:81",
+		},
 	}
 
 	for _, tt := range tests {
@@ -223,6 +241,16 @@ func TestMacroEdgeCases(t *testing.T) {
 			template: "Value: ${@unknown}",
 			checkFn:  func(s string) bool { return s == "Value: ${@unknown}" },
 		},
+		{
+			name:     "unknown macro with fallback",
+			template: `{"ts": "${@unknown?:0}"}`,
+			checkFn:  func(s string) bool { return s == `{"ts": "0"}` },
+		},
+		{
+			name:     "known macro ignores fallback",
+			template: "Time: ${@timestamp?:never}",
+			checkFn:  func(s string) bool { return s != "Time: never" && s != "Time: ${@timestamp?:never}" },
+		},
 		{
 			name:     "macro with spaces",
 			template: "Time: ${ @timestamp }",
@@ -281,3 +309,95 @@ func TestLargeTemplate(t *testing.T) {
 func contains(s, substr string) bool {
 	return strings.Contains(s, substr)
 }
+
+func TestDollarEdgeCases(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "lone dollar", template: "$", want: "$"},
+		{name: "trailing dollar", template: "cost: 5$", want: "cost: 5$"},
+		{name: "trailing dollar after variable", template: "$a$", want: "A$"},
+		{name: "dollar digit", template: "$1 and $2", want: "$1 and $2"},
+		{name: "dollar space", template: "$ a", want: "$ a"},
+		{name: "lone at", template: "a $@ b", want: "a $@ b"},
+		{name: "trailing at", template: "$@", want: "$@"},
+		{name: "unclosed paren", template: "$(a", want: "$(a"},
+		{name: "empty paren", template: "$()", want: "$()"},
+		{name: "trailing brace open", template: "x${", want: "x${"},
+		{name: "double dollar at end", template: "x$$", want: "x$$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			got, err := tmpl.Execute(map[string]string{"a": "A"})
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+			for _, name := range tmpl.Variables() {
+				if name != "a" {
+					t.Errorf("unexpected variable %q", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: `\$name`, want: `$name`},
+		{in: `\${name}`, want: `${name}`},
+		{in: `$${name} $$name`, want: `${name} $name`},
+		{in: `\\${name}`, want: `\${name}`},
+		{in: `${a} \${b} $c`, want: `${a} ${b} $c`},
+		{in: `cost: 5$ or \ alone`, want: `cost: 5$ or \ alone`},
+		{in: `$$ not before a variable`, want: `$$ not before a variable`},
+		{in: `\$a ${a?:\$x} ${b?:$$c}`, want: `$a ${a?:\$x} ${b?:$$c}`},
+		{in: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := Unescape(tt.in); got != tt.want {
+			t.Errorf("Unescape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteStaticNoAlloc(t *testing.T) {
+	for _, src := range []string{"", "static text"} {
+		tmpl := Compile(src)
+		got, err := tmpl.Execute(map[string]string{"unused": "x"})
+		if err != nil || got != src {
+			t.Errorf("Execute(%q) = %q, %v", src, got, err)
+		}
+		if allocs := testing.AllocsPerRun(100, func() { tmpl.Execute(nil) }); allocs != 0 {
+			t.Errorf("Execute(%q) allocates %v times, want 0", src, allocs)
+		}
+	}
+	// options still apply to static templates
+	if _, err := Compile("").ExecuteWithOptions(map[string]string{"x": "1"}, &ApplyOptions{DisallowExtraVars: true}); err == nil {
+		t.Error("expected unknown variable error")
+	}
+}
+
+func TestCompileLiteral(t *testing.T) {
+	tmpl := Compile(`plain {text} with \ backslash`)
+	if tmpl.HasVariables() || tmpl.NumVars() != 0 || tmpl.String() != `plain {text} with \ backslash` {
+		t.Errorf("Compile() = %q with %v", tmpl.String(), tmpl.Variables())
+	}
+
+	tmpl = Compile("Hello ${name}")
+	tmpl.Reset("no variables")
+	if tmpl.HasVariables() || tmpl.NumVars() != 0 {
+		t.Errorf("Reset() kept variables %v", tmpl.Variables())
+	}
+	if got, err := tmpl.Execute(map[string]string{"name": "x"}); err != nil || got != "no variables" {
+		t.Errorf("Execute() = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,109 @@
+package var_template
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// specTag is the struct tag read by BindSpec
+const specTag = "vartmpl"
+
+// varSpecField is a variable declared by a field of a BindSpec struct
+type varSpecField struct {
+	required   bool
+	hasDefault bool
+	def        string
+}
+
+// BindSpec checks the template against a struct declaring its variables
+// and returns a copy with the declared defaults and required flags applied.
+// Each field tagged like `vartmpl:"name,default=8080,required"` declares
+// a variable, an empty name is the field name and "-" skips the field.
+// Defaults cannot contain commas. Referencing an undeclared variable is
+// an error; macros and :file, :bash and :include variables are not checked
+func (c *Template) BindSpec(spec interface{}) (*Template, error) {
+	fields, err := parseSpecStruct(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var undeclared []string
+	seen := make(map[string]bool)
+	for _, vr := range c.varPositions {
+		if vr.isMacro || vr.isFile || vr.isBash || vr.isInclude || seen[vr.varName] {
+			continue
+		}
+		seen[vr.varName] = true
+		if _, ok := fields[vr.varName]; !ok {
+			undeclared = append(undeclared, vr.varName)
+		}
+	}
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		return nil, fmt.Errorf("undeclared variables: %s", strings.Join(undeclared, ", "))
+	}
+
+	varPositions := make([]*varAndPosition, len(c.varPositions))
+	for i, vr := range c.varPositions {
+		if f, ok := fields[vr.varName]; ok && !vr.isMacro && (f.required || f.hasDefault) {
+			vr = vr.clone()
+			vr.required = vr.required || f.required
+			if f.hasDefault {
+				vr.hasDefaultValue = true
+				vr.defaultValue = f.def
+				vr.defaultExpr = nil
+				vr.defaultTemplate = nil
+			}
+		}
+		varPositions[i] = vr
+	}
+
+	t := c.clone()
+	t.varPositions = varPositions
+	// variables referenced only by the replaced defaults are gone
+	t.vars = collectVars(varPositions)
+	return t, nil
+}
+
+// parseSpecStruct reads the declared variables of a struct or struct pointer
+func parseSpecStruct(spec interface{}) (map[string]varSpecField, error) {
+	typ := reflect.TypeOf(spec)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("spec must be a struct or a pointer to one, got %T", spec)
+	}
+	fields := make(map[string]varSpecField, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag, ok := field.Tag.Lookup(specTag)
+		if !ok || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = field.Name
+		}
+		var f varSpecField
+		for _, opt := range parts[1:] {
+			switch {
+			case opt == "required":
+				f.required = true
+			case strings.HasPrefix(opt, "default="):
+				f.hasDefault = true
+				f.def = opt[len("default="):]
+			default:
+				return nil, fmt.Errorf("field %s: unknown %s option %q", field.Name, specTag, opt)
+			}
+		}
+		if _, dup := fields[name]; dup {
+			return nil, fmt.Errorf("field %s: variable %s declared twice", field.Name, name)
+		}
+		fields[name] = f
+	}
+	return fields, nil
+}
@@ -0,0 +1,64 @@
+package var_template
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CompileSprintf converts a fmt.Sprintf style format into a template,
+// the n-th %s, %d or %v verb becomes the variable argNames[n].
+// %% is a literal %, other verbs and flags are not supported.
+func CompileSprintf(format string, argNames ...string) (*Template, error) {
+	var b strings.Builder
+	b.Grow(len(format))
+	argIdx := 0
+	for i := 0; i < len(format); i++ {
+		ch := format[i]
+		if ch == '$' {
+			// keep literal dollars from starting a variable
+			b.WriteString(`\$`)
+			continue
+		}
+		if ch != '%' {
+			b.WriteByte(ch)
+			continue
+		}
+		if i+1 >= len(format) {
+			return nil, fmt.Errorf("incomplete verb at end of format %q", format)
+		}
+		i++
+		verb := format[i]
+		switch verb {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case 's', 'd', 'v':
+		default:
+			return nil, fmt.Errorf("unsupported verb %%%c at offset %d", verb, i-1)
+		}
+		if argIdx >= len(argNames) {
+			return nil, fmt.Errorf("missing name for verb %%%c at offset %d", verb, i-1)
+		}
+		if i >= 2 && format[i-2] == '\\' {
+			return nil, fmt.Errorf("backslash before verb %%%c at offset %d would escape the variable", verb, i-1)
+		}
+		b.WriteString(open)
+		b.WriteString(sprintfVarName(argNames[argIdx]))
+		b.WriteString(close)
+		argIdx++
+	}
+	if argIdx < len(argNames) {
+		return nil, fmt.Errorf("%d names given but format %q has %d verbs", len(argNames), format, argIdx)
+	}
+	return CompileStrict(b.String())
+}
+
+// sprintfVarName quotes name unless it is a plain variable name
+func sprintfVarName(name string) string {
+	if name != "" && !strings.HasPrefix(name, "@") {
+		if plain, _ := parseVariableNameAndRequired(name, false); plain == name {
+			return name
+		}
+	}
+	return `"` + name + `"`
+}
@@ -1,19 +1,35 @@
 package var_template
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"html"
+	"io/fs"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Template struct {
 	template     string
 	varPositions []*varAndPosition
 	vars         []string
+	bindings     map[string]string // deferred values, materialized at Execute
+	aliases      map[string]string // alias -> canonical name, see WithAlias
+	validators   map[string]func(value string) error
+	compileOpts  CompileOptions
+	warnings     []CompileWarning
+	varErrors    map[string]error // invalid ${...} kept as literal text, by source text
+	// required groups checked by Execute, see WithRequiredGroup
+	requiredGroups []requiredGroup
 }
 
 func (c *Template) HasVariables() bool {
@@ -31,12 +47,184 @@ func (c *Template) HasNonMacroVariables() bool {
 func (c *Template) GetGetRaw(varName string) string {
 	for _, position := range c.varPositions {
 		if position.varName == varName {
-			return position.raw
+			return position.display()
 		}
 	}
 	return ""
 }
 
+// clone returns a shallow copy of the template whose slices do not share
+// backing arrays with c, so that a later Reset of either leaves the other intact
+func (c *Template) clone() *Template {
+	t := *c
+	t.varPositions = append([]*varAndPosition(nil), c.varPositions...)
+	t.vars = append([]string(nil), c.vars...)
+	t.warnings = append([]CompileWarning(nil), c.warnings...)
+	return &t
+}
+
+// Reset recompiles the template in place, reusing the capacity
+// of the existing slices, like bytes.Buffer.Reset.
+// Slices previously returned by Variables are overwritten, copies
+// returned by methods such as Bind or WithAlias are not affected.
+// Bindings, aliases, validators and required groups of the previous
+// template are dropped.
+func (c *Template) Reset(template string) {
+	c.bindings = nil
+	c.aliases = nil
+	c.validators = nil
+	c.requiredGroups = nil
+	// Reset cannot report errors, so neither strictness nor limits apply
+	opts := c.compileOpts
+	opts.Strict = false
+	opts.MaxVars, opts.MaxLength = 0, 0
+	c.compile(template, &opts)
+}
+
+// CompileWarnings returns the issues a lenient compile kept as literal
+// text, such as unclosed braces and invalid variables
+func (c *Template) CompileWarnings() []CompileWarning {
+	return c.warnings
+}
+
+// VarErrors returns why each ${...} a lenient compile kept as literal
+// text is invalid, keyed by its source text like "${a:b:c}".
+// It is nil if every variable is valid
+func (c *Template) VarErrors() map[string]error {
+	return c.varErrors
+}
+
+// RawSpan returns the byte range and text of the i-th variable
+// including its delimiters, such that Template()[start:end] == text
+func (c *Template) RawSpan(i int) (start int, end int, text string) {
+	vr := c.varPositions[i]
+	start, end = vr.open, getVarEndPos(c.template, vr)
+	return start, end, c.template[start:end]
+}
+
+// Subtemplate returns the byte range [start, end) of Template() as its own
+// template, variables inside the range are re-based to zero.
+// A variable straddling either boundary is an error
+func (c *Template) Subtemplate(start, end int) (*Template, error) {
+	if start < 0 || end > len(c.template) || start > end {
+		return nil, fmt.Errorf("invalid range [%d, %d) for template of length %d", start, end, len(c.template))
+	}
+	var positions []*varAndPosition
+	varMap := make(map[string]bool)
+	for _, vr := range c.varPositions {
+		vrEnd := getVarEndPos(c.template, vr)
+		if vrEnd <= start || vr.open >= end {
+			continue
+		}
+		if vr.open < start || vrEnd > end {
+			return nil, fmt.Errorf("variable %s at [%d, %d) straddles range [%d, %d)", vr.display(), vr.open, vrEnd, start, end)
+		}
+		cpVar := vr.clone()
+		cpVar.open -= start
+		cpVar.close -= start
+		positions = append(positions, cpVar)
+		varMap[vr.varName] = true
+		for _, ref := range vr.refs() {
+			varMap[ref] = true
+		}
+	}
+	return &Template{
+		template:     c.template[start:end],
+		varPositions: positions,
+		vars:         getVars(varMap),
+		bindings:     c.bindings,
+		aliases:      c.aliases,
+		validators:   c.validators,
+		compileOpts:  c.compileOpts,
+	}, nil
+}
+
+// ReplaceVarWithLiteral returns a copy of the template in which every
+// occurrence of the named variable is replaced by literal text, which is
+// not parsed for variables. Other variables are re-offset and kept
+func (c *Template) ReplaceVarWithLiteral(name string, literal string) *Template {
+	var b strings.Builder
+	var positions []*varAndPosition
+	varMap := make(map[string]bool)
+	oldIdx := 0
+	for j, vr := range c.varPositions {
+		end := c.varEndPos(j)
+		if vr.varName == name {
+			b.WriteString(c.template[oldIdx:vr.open])
+			b.WriteString(literal)
+			oldIdx = end
+			continue
+		}
+		shift := b.Len() - oldIdx
+		cpVar := vr.clone()
+		cpVar.open += shift
+		cpVar.close += shift
+		positions = append(positions, cpVar)
+		varMap[vr.varName] = true
+		for _, ref := range vr.refs() {
+			varMap[ref] = true
+		}
+	}
+	b.WriteString(c.template[oldIdx:])
+
+	t := *c
+	t.template = b.String()
+	t.varPositions = positions
+	t.vars = getVars(varMap)
+	t.warnings = nil
+	t.varErrors = nil
+	return &t
+}
+
+// WrapWith returns a copy of the template with literal prefix and suffix
+// text, e.g. a generated-file banner, without reparsing. The text is not
+// parsed for variables
+func (c *Template) WrapWith(prefix string, suffix string) *Template {
+	positions := make([]*varAndPosition, len(c.varPositions))
+	for j, vr := range c.varPositions {
+		cpVar := vr.clone()
+		cpVar.open += len(prefix)
+		cpVar.close += len(prefix)
+		positions[j] = cpVar
+	}
+	t := c.clone()
+	t.template = prefix + c.template + suffix
+	t.varPositions = positions
+	t.warnings = nil
+	t.varErrors = nil
+	return t
+}
+
+// Defaults returns the ?: default of each variable that has one,
+// the first occurrence wins. Defaults of secret variables are ***
+func (c *Template) Defaults() map[string]string {
+	defaults := make(map[string]string)
+	for _, vr := range c.varPositions {
+		if !vr.hasDefaultValue {
+			continue
+		}
+		if _, ok := defaults[vr.varName]; ok {
+			continue
+		}
+		if vr.isSecret {
+			defaults[vr.varName] = "***"
+		} else {
+			defaults[vr.varName] = vr.defaultValue
+		}
+	}
+	return defaults
+}
+
+// HasDefaultFor reports whether any occurrence of the named variable has a ?: default
+func (c *Template) HasDefaultFor(name string) bool {
+	for _, vr := range c.varPositions {
+		if vr.varName == name && vr.hasDefaultValue {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Template) UpdateVars(newVars []string) {
 	c.vars = newVars
 }
@@ -45,6 +233,41 @@ func (c *Template) NumVars() int {
 	return len(c.varPositions)
 }
 
+// NumMacros returns the number of macro occurrences, a template
+// without macros renders the same output for the same vars
+func (c *Template) NumMacros() int {
+	n := 0
+	for _, vr := range c.varPositions {
+		if vr.isMacro {
+			n++
+		}
+	}
+	return n
+}
+
+// CountByKind returns the number of variable occurrences of the given kind,
+// e.g. to flag templates running :bash commands
+func (c *Template) CountByKind(kind VarKind) int {
+	n := 0
+	for _, vr := range c.varPositions {
+		if vr.Kind() == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// MacroOccurrences returns how many times each macro occurs
+func (c *Template) MacroOccurrences() map[string]int {
+	counts := make(map[string]int)
+	for _, vr := range c.varPositions {
+		if vr.isMacro {
+			counts[vr.varName]++
+		}
+	}
+	return counts
+}
+
 func (c *Template) Var(i int) Var {
 	return c.varPositions[i]
 }
@@ -53,6 +276,97 @@ func (c *Template) Variables() []string {
 	return c.vars
 }
 
+// ValidateAgainst returns an error listing every non-macro
+// variable that is not in the allowed list, secret variables
+// are listed as ***
+func (c *Template) ValidateAgainst(allowed []string) error {
+	allowedMap := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		allowedMap[name] = true
+	}
+	secrets := make(map[string]bool)
+	for _, vr := range c.varPositions {
+		if vr.isSecret {
+			secrets[vr.varName] = true
+		}
+	}
+	unknownMap := make(map[string]bool)
+	for _, vr := range c.varPositions {
+		if vr.isMacro || allowedMap[vr.varName] {
+			continue
+		}
+		if secrets[vr.varName] {
+			unknownMap["***"] = true
+		} else {
+			unknownMap[vr.varName] = true
+		}
+	}
+	if len(unknownMap) == 0 {
+		return nil
+	}
+	return fmt.Errorf("unknown variables: %s", strings.Join(getVars(unknownMap), ", "))
+}
+
+// LiteralSize returns the total bytes of non-variable text
+func (c *Template) LiteralSize() int {
+	size := len(c.template)
+	for _, vr := range c.varPositions {
+		size -= getVarEndPos(c.template, vr) - vr.open
+	}
+	return size
+}
+
+// estimateSize estimates the rendered size: literal text plus the supplied
+// values, variables without a value are assumed to keep their source text
+func (c *Template) estimateSize(vars map[string]string) int {
+	size := len(c.template)
+	for j, vr := range c.varPositions {
+		if val, _, ok := lookupVar(vars, c.aliases, vr.varName); ok && !vr.isMacro && !vr.isFile && !vr.isBash && !vr.isInclude {
+			size += len(val) - (c.varEndPos(j) - vr.open)
+		}
+	}
+	return size
+}
+
+// varEndPos returns the end offset of the j-th variable
+func (c *Template) varEndPos(j int) int {
+	return getVarEndPos(c.template, c.varPositions[j])
+}
+
+// Fingerprint returns a hash of the template text, its variables with their
+// directives, bindings, aliases and required groups. It is stable across
+// process runs.
+func (c *Template) Fingerprint() uint64 {
+	h := fnv.New64a()
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	write(c.template)
+	for _, vr := range c.varPositions {
+		write(vr.varName)
+		write(strconv.FormatBool(vr.required))
+		write(strconv.FormatBool(vr.hasDefaultValue))
+		write(vr.defaultValue)
+		write(strings.Join(vr.directives, ":"))
+	}
+	for _, name := range sortedKeys(c.bindings) {
+		write(name)
+		write(c.bindings[name])
+	}
+	for _, alias := range sortedKeys(c.aliases) {
+		write("alias " + alias)
+		write(c.aliases[alias])
+	}
+	for _, g := range c.requiredGroups {
+		write("group " + strconv.FormatBool(g.exactlyOne))
+		for _, name := range g.names {
+			write(name)
+		}
+	}
+	return h.Sum64()
+}
+
 // get current template
 func (c *Template) Template() string {
 	return c.template
@@ -61,11 +375,120 @@ func (c *Template) String() string {
 	return c.template
 }
 
+// MarshalText implements encoding.TextMarshaler with a debug form of the
+// template: its quoted source followed by one line per variable, in the
+// order of Variables, with its directives, required flag and default as
+// in Diff. Secret variables are redacted as ${***} in the source and
+// as *** in the list. Use String for the plain text. Being a
+// TextMarshaler, json.Marshal encodes a Template as this debug form
+// instead of {}
+func (c *Template) MarshalText() ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "template %q", c.redactedSource())
+	meta := varMetadata(c)
+	for _, name := range c.vars {
+		b.WriteString("\n  ")
+		if c.isSecretVar(name) {
+			b.WriteString("***")
+		} else {
+			b.WriteString(name)
+		}
+		for _, m := range meta[name] {
+			b.WriteString(" ")
+			b.WriteString(m)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// isSecretVar reports whether any occurrence of name is :secret
+func (c *Template) isSecretVar(name string) bool {
+	for _, vr := range c.varPositions {
+		if vr.isSecret && vr.varName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedSource returns the template text with each secret variable
+// replaced by ${***}
+func (c *Template) redactedSource() string {
+	var b strings.Builder
+	last := 0
+	for j, vr := range c.varPositions {
+		if !vr.isSecret {
+			continue
+		}
+		b.WriteString(c.template[last:vr.open])
+		b.WriteString(open + vr.display() + close)
+		last = c.varEndPos(j)
+	}
+	if last == 0 {
+		return c.template
+	}
+	b.WriteString(c.template[last:])
+	return b.String()
+}
+
+// PartialApply substitutes the given vars and keeps the other variables.
+// A variable whose value fails :idx, :clamp or a validator is kept as well,
+// Execute reports the error once it is given again
 func (c *Template) PartialApply(vars map[string]string) *Template {
 	if len(vars) == 0 {
 		return c
 	}
-	t, err := c.apply(vars, false, false, false)
+	t, err := c.apply(vars, &ApplyOptions{keepInvalid: true})
+	if err != nil {
+		// un expected
+		panic(err)
+	}
+	return t
+}
+
+// PartialApplyOptions customizes PartialApplyWith
+type PartialApplyOptions struct {
+	// Format, if set, renders each variable left unresolved, e.g. as
+	// {{name}} for another templating system. Nil keeps the original text.
+	// Macros are always kept as is
+	Format func(v Var) string
+}
+
+// PartialApplyWith is like PartialApply with options. Variables rendered
+// by Format become literal text of the returned template
+func (c *Template) PartialApplyWith(vars map[string]string, opts *PartialApplyOptions) *Template {
+	if opts == nil || opts.Format == nil {
+		return c.PartialApply(vars)
+	}
+	t, err := c.apply(vars, &ApplyOptions{
+		MissingValue: func(v Var) (string, bool) {
+			return opts.Format(v), true
+		},
+		keepInvalid: true,
+	})
+	if err != nil {
+		// un expected
+		panic(err)
+	}
+	return t
+}
+
+// ApplyOnly is like PartialApply but substitutes only the named variables,
+// the others are left as placeholders even if vars has their values
+func (c *Template) ApplyOnly(names []string, vars map[string]string) *Template {
+	subset := make(map[string]string, len(names))
+	for _, name := range names {
+		if val, _, ok := lookupVar(vars, c.aliases, name); ok {
+			subset[name] = val
+		}
+	}
+	return c.PartialApply(subset)
+}
+
+// ResolveMacros returns a new template with macros such as @timestamp
+// resolved, variables and their defaults are left untouched
+func (c *Template) ResolveMacros() *Template {
+	t, err := c.apply(nil, &ApplyOptions{ApplyMacro: true})
 	if err != nil {
 		// un expected
 		panic(err)
@@ -77,13 +500,201 @@ type ApplyOptions struct {
 	ApplyDefault     bool
 	ApplyMacro       bool
 	ValidateRequired bool
+	// ErrorOnUnknownMacro makes an unknown macro without fallback an
+	// error instead of leaving it as is, only effective with ApplyMacro
+	ErrorOnUnknownMacro bool
+	// DisableNumberUnquote keeps the quotes around :%d variables,
+	// the value is only validated to be an integer
+	DisableNumberUnquote bool
+	// NumberFormat, if set, formats the value of every :%d and :clamp
+	// variable as an int64 with fmt.Sprintf, e.g. %05d, after clamping.
+	// There are no per-variable widths, the override applies to all of them.
+	// A value that is not an integer is an error. Empty keeps values as given
+	NumberFormat string
+	// ListSeparator splits the value of :+, :* and :idx variables into a list,
+	// defaults to ",". A per-variable separator like ${items:+;} takes precedence
+	ListSeparator string
+	// CollapseEmptyGaps removes one space around a variable rendered as empty:
+	// the space before it, or the space after it when nothing precedes it
+	// in the output
+	CollapseEmptyGaps bool
+	// LooseShellQuote makes :shell_quote only quote values with whitespace
+	// or one of ;<>\${}()&!*, instead of any value with a character
+	// outside [A-Za-z0-9._/-]
+	LooseShellQuote bool
+	// ErrorOnClamp makes an out of range :clamp value an error instead of clamping it
+	ErrorOnClamp bool
+	// Defaults, if set, provides values for variables missing from vars,
+	// tried after the environment and before inline ?: defaults.
+	// Only effective with ApplyDefault
+	Defaults map[string]string
+	// RequiredOverridesDefaults makes a required variable an error unless
+	// it is in vars, even if Defaults, the environment or an inline default
+	// provides a value. Only effective with ValidateRequired
+	RequiredOverridesDefaults bool
+	// RequireAll treats every variable without a ?: default as required,
+	// except macros and conditional sections. Only effective with ValidateRequired
+	RequireAll bool
+	// DisallowExtraVars makes keys of vars not referenced by the template
+	// an error listing all of them, checked before rendering. Variables of
+	// :include templates count as referenced, the check then runs after them
+	DisallowExtraVars bool
+	// EmptyAsMissing treats an empty value in vars like a missing one,
+	// so ${value?:X} renders X for a blank value too
+	EmptyAsMissing bool
+	// EmptyNumberAsZero renders an empty value of a :%d variable without
+	// a ?: default as 0. With a default, an empty value always falls back to it
+	EmptyNumberAsZero bool
+	// MissingValue, if set, is asked for a placeholder of a missing non-macro
+	// variable, returning false keeps the variable as is
+	MissingValue func(v Var) (string, bool)
+	// Now, if set, is the clock of the builtin timestamp macros
+	Now func() time.Time
+	// MacroResolver, if set, is asked for a macro by its name without @
+	// before the builtins, e.g. secret.DB_PASS for ${@secret.DB_PASS}.
+	// Returning false falls through to the builtins. Only effective with ApplyMacro
+	MacroResolver func(name string) (func() (string, error), bool)
+	// FS, if set, is the filesystem :file variables are read from,
+	// e.g. an embed.FS, instead of the OS filesystem
+	FS fs.FS
+	// VisitedFiles, if set, guards against self-reference: every path read
+	// by a :file or :include variable is added to it and reading a path
+	// already in it is an error. Seed it with the path of the template being
+	// rendered. Only file paths are tracked, a :bash command re-invoking the
+	// renderer is not detected
+	VisitedFiles map[string]bool
+
+	// includeDepth is the nesting of :include templates being rendered
+	includeDepth int
+	// includedVars collects the variables of :include templates, for
+	// DisallowExtraVars deferred until they are read
+	includedVars map[string]bool
+	// onUse, if set, is called with the key of every value taken from vars:
+	// substituted variables and operands of computed defaults
+	onUse func(key string)
+	// emitted holds the names of :once variables already rendered, shared
+	// with fragment defaults
+	emitted map[string]bool
+	// keepInvalid leaves a variable whose value fails :idx, :clamp or a
+	// validator unresolved instead of failing, for partial application
+	keepInvalid bool
+	// BashRunner, if set, runs the command of :bash variables instead of
+	// bash -c, its output is used verbatim without trimming newlines
+	BashRunner func(ctx context.Context, cmd string) (string, error)
+
+	// MarkDefaults, if set, is called with the name of every variable
+	// falling back to its ?: default, not for the Defaults map
+	MarkDefaults func(name string)
+
+	// OnSubstitute, if set, is called for every variable written to the output,
+	// values of secret variables are passed as ***
+	OnSubstitute func(name string, source SubstitutionSource, value string)
+}
+
+// SubstitutionSource tells where a substituted value came from
+type SubstitutionSource int
+
+const (
+	SourceVars    SubstitutionSource = 0 // the vars map
+	SourceDefault SubstitutionSource = 1 // the ?: default
+	SourceMacro   SubstitutionSource = 2 // a macro such as @timestamp
+	SourceFile    SubstitutionSource = 3 // :file
+	SourceBash    SubstitutionSource = 4 // :bash
+	SourceEnv     SubstitutionSource = 5 // :env:NAME
+	// ApplyOptions.MissingValue
+	SourceMissingValue SubstitutionSource = 6
+	SourceInclude      SubstitutionSource = 7 // :include
+)
+
+func (s SubstitutionSource) String() string {
+	switch s {
+	case SourceVars:
+		return "vars"
+	case SourceDefault:
+		return "default"
+	case SourceMacro:
+		return "macro"
+	case SourceFile:
+		return "file"
+	case SourceBash:
+		return "bash"
+	case SourceEnv:
+		return "env"
+	case SourceMissingValue:
+		return "missing_value"
+	case SourceInclude:
+		return "include"
+	}
+	return fmt.Sprintf("SubstitutionSource(%d)", int(s))
+}
+
+// maxIncludeDepth bounds nested :include, e.g. a template including itself
+const maxIncludeDepth = 16
+
+// include reads, compiles and renders the template at path with the same
+// vars and options, the path is not relative to the including template
+func (c *Template) include(path string, vars map[string]string, opts *ApplyOptions) (*Template, error) {
+	if opts.includeDepth >= maxIncludeDepth {
+		return nil, fmt.Errorf("include %s: nested more than %d levels", path, maxIncludeDepth)
+	}
+	if err := opts.visit(path); err != nil {
+		return nil, err
+	}
+	data, err := opts.readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include %s: %v", path, err)
+	}
+	t, err := compile(string(data), &c.compileOpts)
+	if err != nil {
+		return nil, fmt.Errorf("include %s: %v", path, err)
+	}
+	t.aliases = c.aliases
+	t.validators = c.validators
+	if opts.includedVars != nil {
+		for _, name := range t.vars {
+			opts.includedVars[name] = true
+			if canonical, ok := c.aliases[name]; ok {
+				opts.includedVars[canonical] = true
+			}
+		}
+	}
+	// vars are checked by the including template
+	nestedOpts := *opts
+	nestedOpts.DisallowExtraVars = false
+	nestedOpts.includeDepth++
+	rendered, err := t.apply(vars, &nestedOpts)
+	if err != nil {
+		return nil, fmt.Errorf("include %s: %v", path, err)
+	}
+	return rendered, nil
+}
+
+// visit records path in VisitedFiles, failing if it was read already
+func (o *ApplyOptions) visit(path string) error {
+	if o.VisitedFiles == nil {
+		return nil
+	}
+	name := filepath.Clean(path)
+	if o.VisitedFiles[name] {
+		return fmt.Errorf("file %s is read more than once", path)
+	}
+	o.VisitedFiles[name] = true
+	return nil
+}
+
+// readFile reads name from FS if set, otherwise from the OS filesystem
+func (o *ApplyOptions) readFile(name string) ([]byte, error) {
+	if o.FS != nil {
+		return fs.ReadFile(o.FS, name)
+	}
+	return os.ReadFile(name)
 }
 
 func (c *Template) Apply(vars map[string]string, opts *ApplyOptions) *Template {
 	if len(vars) == 0 && !opts.ApplyDefault && !opts.ApplyMacro {
 		return c
 	}
-	t, err := c.apply(vars, opts.ValidateRequired, opts.ApplyDefault, opts.ApplyMacro)
+	t, err := c.apply(vars, opts)
 	if err != nil {
 		// un expected
 		panic(err)
@@ -91,62 +702,188 @@ func (c *Template) Apply(vars map[string]string, opts *ApplyOptions) *Template {
 	return t
 }
 
-func (c *Template) apply(vars map[string]string, validateRequired bool, applyDefault bool, applyMacro bool) (*Template, error) {
-	if len(c.vars) == 0 && !applyDefault && !applyMacro {
+// renderBuffer collects the output of render, or only its length
+type renderBuffer struct {
+	b         strings.Builder
+	countOnly bool
+	n         int
+}
+
+func (r *renderBuffer) WriteString(s string) {
+	if r.countOnly {
+		r.n += len(s)
+		return
+	}
+	r.b.WriteString(s)
+}
+
+func (r *renderBuffer) Len() int {
+	if r.countOnly {
+		return r.n
+	}
+	return r.b.Len()
+}
+
+func (c *Template) apply(vars map[string]string, opts *ApplyOptions) (*Template, error) {
+	return c.render(vars, opts, nil)
+}
+
+// render applies vars to the template. If count is not nil only the length
+// of the output is computed and stored in it, the returned template is then
+// not usable
+func (c *Template) render(vars map[string]string, opts *ApplyOptions, count *int) (*Template, error) {
+	if opts.DisallowExtraVars {
+		if c.CountByKind(KindInclude) > 0 {
+			// vars used only by an included template are known once it is read
+			deferred := *opts
+			deferred.DisallowExtraVars = false
+			deferred.includedVars = make(map[string]bool)
+			t, err := c.render(vars, &deferred, count)
+			if err != nil {
+				return nil, err
+			}
+			if extra := c.extraVars(vars, deferred.includedVars); len(extra) > 0 {
+				return nil, fmt.Errorf("unknown variables: %s", strings.Join(extra, ", "))
+			}
+			return t, nil
+		}
+		if extra := c.extraVars(vars, nil); len(extra) > 0 {
+			return nil, fmt.Errorf("unknown variables: %s", strings.Join(extra, ", "))
+		}
+	}
+	if len(c.vars) == 0 && !opts.ApplyDefault && !opts.ApplyMacro || len(c.varPositions) == 0 {
+		// static text, e.g. an empty template, renders to itself
+		if count != nil {
+			*count = len(c.template)
+		}
 		return c, nil
 	}
 	s := c.template
-	var b strings.Builder
-	b.Grow(len(s))
+	// a local buffer, kept on the stack
+	b := renderBuffer{countOnly: count != nil}
+	if count == nil {
+		b.b.Grow(c.estimateSize(vars))
+	}
 	oldIdx := 0
 
 	var missingVarPositions []*varAndPosition
 	missingVarMap := make(map[string]bool)
+	// keepVar copies vr, ending at varEndPos, unresolved to the output
+	keepVar := func(vr *varAndPosition, varEndPos int) {
+		cpVar := vr.clone()
+		cpVar.open = b.Len() + (vr.open - oldIdx)
+		cpVar.close = b.Len() + (vr.close - oldIdx)
+		missingVarPositions = append(missingVarPositions, cpVar)
+		missingVarMap[vr.varName] = true
+		for _, name := range vr.refs() {
+			missingVarMap[name] = true
+		}
+		b.WriteString(s[oldIdx:varEndPos])
+		oldIdx = varEndPos
+	}
+	// names of :once variables already rendered
+	emitted := opts.emitted
+	// lookup reads a variable referenced by another one, e.g. by a default
+	lookup := func(name string) (string, bool) {
+		val, key, ok := lookupVar(vars, c.aliases, name)
+		if ok && opts.onUse != nil {
+			opts.onUse(key)
+		}
+		return val, ok
+	}
 	// each varPosition represents its prefix upto its close
 	// the last varPosition may have trailing suffix
 	for j, vr := range c.varPositions {
 		var val string
 		var ok bool
+		var included *Template // rendered :include, may keep missing variables
+		source := SourceVars
+		key := vr.varName // the key of vars the value is taken from
 
 		if vr.isFile {
+			source = SourceFile
 			// also use varname as file directly
-			if data, err := os.ReadFile(vr.varName); err == nil {
+			if err := opts.visit(vr.varName); err != nil {
+				return nil, err
+			}
+			if data, err := opts.readFile(vr.varName); err == nil {
 				val = string(data)
 				ok = true
 			} else {
 				return nil, fmt.Errorf("failed to read file %s: %v", vr.varName, err)
 			}
+		} else if vr.isInclude {
+			source = SourceInclude
+			var err error
+			if included, err = c.include(vr.varName, vars, opts); err != nil {
+				return nil, err
+			}
+			val = included.template
+			ok = true
 		} else if vr.isBash {
-			// Execute bash command using variable name
-			cmd := exec.Command("bash", "-c", vr.varName)
-			if output, err := cmd.Output(); err == nil {
-				val = strings.TrimRight(string(output), "\n\r")
+			source = SourceBash
+			if opts.BashRunner != nil {
+				output, err := opts.BashRunner(context.Background(), vr.varName)
+				if err != nil {
+					return nil, fmt.Errorf("failed to execute bash command %s: %v", vr.varName, err)
+				}
+				val = output
 				ok = true
 			} else {
-				return nil, fmt.Errorf("failed to execute bash command %s: %v", vr.varName, err)
+				// Execute bash command using variable name
+				cmd := exec.Command("bash", "-c", vr.varName)
+				if output, err := cmd.Output(); err == nil {
+					val = strings.TrimRight(string(output), "\n\r")
+					ok = true
+				} else {
+					return nil, fmt.Errorf("failed to execute bash command %s: %v", vr.varName, err)
+				}
 			}
 		} else if vr.isMacro {
-			if applyMacro {
-				macro := vr.varName
-				if strings.HasPrefix(macro, "@") {
-					macro = macro[1:] // Remove @ prefix
+			if opts.ApplyMacro {
+				source = SourceMacro
+				var err error
+				if val, ok, err = lookupMacro(vr.varName, opts); err != nil {
+					return nil, err
 				}
-				if macro == "timestamp" {
-					val = strconv.FormatInt(time.Now().Unix(), 10)
-					ok = true
-				} else if macro == "timestamp_ms" {
-					val = strconv.FormatInt(unixMilli(time.Now()), 10)
-					ok = true
-				} else if macro == "timestamp_us" {
-					val = strconv.FormatInt(unixMicro(time.Now()), 10)
-					ok = true
-				} else if macro == "timestamp_ns" {
-					val = strconv.FormatInt(time.Now().UnixNano(), 10)
+				if !ok && vr.hasDefaultValue {
+					source = SourceDefault
+					val = vr.defaultValue
 					ok = true
+					if opts.MarkDefaults != nil {
+						opts.MarkDefaults(vr.varName)
+					}
+				}
+				if !ok && opts.ErrorOnUnknownMacro {
+					return nil, fmt.Errorf("unknown macro %s", vr.varName)
 				}
 			}
 		} else {
-			val, ok = vars[vr.varName]
+			val, key, ok = lookupVar(vars, c.aliases, vr.varName)
+			if ok && val == "" && vr.isNumber {
+				// a blank :%d value, like a form field left empty, falls back
+				// to the default if any, then to 0 with EmptyNumberAsZero
+				if opts.ApplyDefault && vr.hasDefaultValue {
+					ok = false
+				} else if opts.EmptyNumberAsZero {
+					val = "0"
+				}
+			}
+			if ok && val == "" && opts.EmptyAsMissing {
+				ok = false
+			}
+			if !ok && opts.ApplyDefault && vr.envName != "" {
+				source = SourceEnv
+				val, ok = os.LookupEnv(vr.envName)
+				if !ok {
+					source = SourceVars
+				}
+			}
+			if !ok && opts.ApplyDefault && opts.Defaults != nil {
+				if val, ok = opts.Defaults[vr.varName]; ok {
+					source = SourceDefault
+				}
+			}
 		}
 
 		// Calculate the end position of the variable
@@ -160,42 +897,200 @@ func (c *Template) apply(vars map[string]string, validateRequired bool, applyDef
 		}
 
 		if !ok {
-			if applyDefault && !vr.isMacro && vr.hasDefaultValue {
+			if opts.ApplyDefault && !vr.isMacro && vr.hasDefaultValue {
+				source = SourceDefault
 				val = vr.defaultValue
 				ok = true // Mark as ok so directives can be applied
-			} else {
-				if validateRequired && vr.required {
-					return nil, fmt.Errorf("required variable %s is missing", vr.raw)
+				if vr.defaultExpr != nil {
+					var err error
+					val, ok, err = vr.defaultExpr.eval(lookup)
+					if err == nil && ok {
+						err = vr.defaultExpr.validate(lookup, c.validators)
+					}
+					if err != nil {
+						if opts.keepInvalid {
+							keepVar(vr, varEndPos)
+							continue
+						}
+						return nil, fmt.Errorf("default of %s: %v", vr.display(), err)
+					}
+				} else if vr.defaultTemplate != nil {
+					// usable only when every variable of the fragment resolves
+					// vars were checked against the whole template already
+					nestedOpts := *opts
+					nestedOpts.DisallowExtraVars = false
+					// the placeholder is substituted once, by this template
+					nestedOpts.OnSubstitute = nil
+					if emitted == nil {
+						emitted = make(map[string]bool)
+					}
+					nestedOpts.emitted = emitted
+					fragment := *vr.defaultTemplate
+					fragment.aliases = c.aliases
+					fragment.validators = c.validators
+					t, err := fragment.apply(vars, &nestedOpts)
+					if err != nil {
+						return nil, fmt.Errorf("default of %s: %v", vr.display(), err)
+					}
+					val, ok = t.template, !t.HasVariables()
 				}
-				cpVar := vr.clone()
-				cpVar.open = b.Len() + (vr.open - oldIdx)
-				cpVar.close = b.Len() + (vr.close - oldIdx)
-				missingVarPositions = append(missingVarPositions, cpVar)
-				missingVarMap[vr.varName] = true
-				b.WriteString(s[oldIdx:varEndPos])
-				oldIdx = varEndPos
+				if ok && opts.MarkDefaults != nil {
+					opts.MarkDefaults(vr.varName)
+				}
+			} else if opts.ApplyDefault && vr.isConditional {
+				// drop the whole conditional section
+				source = SourceDefault
+				val = ""
+				ok = true
+			} else if opts.MissingValue != nil && !vr.isMacro {
+				source = SourceMissingValue
+				val, ok = opts.MissingValue(vr)
+			}
+			if !ok {
+				if opts.ValidateRequired && (vr.required || opts.RequireAll && !vr.hasDefaultValue && !vr.isMacro && !vr.isConditional) {
+					line, column := lineColumn(s, vr.open)
+					return nil, &RequiredVarError{Name: vr.display(), Offset: vr.open, Line: line, Column: column}
+				}
+				keepVar(vr, varEndPos)
 				continue
 			}
 		}
 
+		if opts.RequiredOverridesDefaults && opts.ValidateRequired && vr.required &&
+			!vr.isMacro && !vr.isFile && !vr.isBash && !vr.isInclude && source != SourceVars {
+			return nil, fmt.Errorf("required variable %s must be provided explicitly", vr.display())
+		}
+
 		// Process other directives if value is found (from variables or default)
-		if ok && val != "" && !vr.isBash && !vr.isFile {
-			if vr.isShellQuote {
+		transform := vr.transformIf == ""
+		if ok && !transform {
+			gate, _ := lookup(vr.transformIf)
+			transform = isTruthy(gate)
+		}
+		if ok && val != "" && !vr.isBash && !vr.isFile && !vr.isInclude {
+			if vr.hasReplace && vr.replaceFrom != "" {
+				val = strings.ReplaceAll(val, vr.replaceFrom, vr.replaceTo)
+			}
+			if vr.hasJoin {
+				val = rejoin(val, vr.joinSep, vr.joinWith)
+			}
+			if vr.repeatMode != repeatMode_Same {
+				val = expandList(val, vr, opts)
+			}
+			if vr.isShellQuote && transform {
 				// Shell quote the value
-				val = quoteShellStr(val)
+				if opts.LooseShellQuote {
+					val = quoteShellStrLoose(val)
+				} else {
+					val = quoteShellStr(val)
+				}
+			}
+			if vr.isHTML && transform {
+				val = html.EscapeString(val)
+			}
+			if vr.isURLEncode && transform {
+				val = url.QueryEscape(val)
+			}
+			if vr.isConditional {
+				val = vr.conditionalText + val
+			}
+		} else if ok && val == "" && vr.isShellQuote && transform {
+			// an empty argument must not disappear from the command line
+			val = "''"
+		}
+
+		var err error
+		if vr.hasIndex {
+			val, err = listItem(val, vr, opts)
+		}
+
+		if err == nil && vr.hasClamp {
+			val, err = clampNumber(val, vr, opts.ErrorOnClamp)
+		}
+
+		if err == nil && vr.isNumber && opts.NumberFormat != "" && val != "" {
+			n, parseErr := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+			if parseErr != nil {
+				err = fmt.Errorf("variable %s: %q is not a number", vr.display(), val)
+			} else {
+				val = fmt.Sprintf(opts.NumberFormat, n)
+			}
+		}
+
+		if err == nil && vr.isNumber && opts.DisableNumberUnquote {
+			if _, parseErr := strconv.ParseInt(strings.TrimSpace(val), 10, 64); parseErr != nil {
+				err = fmt.Errorf("variable %s: %q is not a number", vr.display(), val)
+			}
+		}
+
+		if validate := c.validators[vr.varName]; err == nil && validate != nil {
+			if validateErr := validate(val); validateErr != nil {
+				err = fmt.Errorf("variable %s: %w", vr.display(), validateErr)
+			}
+		}
+
+		if err != nil {
+			if !opts.keepInvalid {
+				return nil, err
+			}
+			keepVar(vr, varEndPos)
+			continue
+		}
+
+		if vr.isOnce {
+			if emitted[vr.varName] {
+				val = ""
+			} else {
+				if emitted == nil {
+					emitted = make(map[string]bool)
+				}
+				emitted[vr.varName] = true
 			}
 		}
 
-		if vr.isNumber &&
+		if source == SourceVars && opts.onUse != nil && !vr.isFile && !vr.isBash && !vr.isInclude && !vr.isMacro {
+			opts.onUse(key)
+		}
+		if opts.OnSubstitute != nil {
+			if vr.isSecret {
+				opts.OnSubstitute(vr.varName, source, "***")
+			} else {
+				opts.OnSubstitute(vr.varName, source, val)
+			}
+		}
+
+		if vr.isNumber && !opts.DisableNumberUnquote &&
 			isChar(s, vr.open-1, '"') &&
 			isChar(s, varEndPos, '"') &&
-			(j == 0 || !c.varPositions[j-1].isNumber || vr.open-1 > getVarEndPos(s, c.varPositions[j-1])) /*does not cross with previous var's ending*/ {
+			(j == 0 || !c.varPositions[j-1].isNumber || vr.open-1 > c.varEndPos(j-1)) /*does not cross with previous var's ending*/ {
 			// trim quotes
 			b.WriteString(s[oldIdx : vr.open-1])
 			b.WriteString(val)
 			oldIdx = varEndPos + 1 /*len of "*/
 		} else {
-			b.WriteString(s[oldIdx:vr.open])
+			prefixEnd := vr.open
+			if opts.CollapseEmptyGaps && val == "" {
+				if vr.open-1 >= oldIdx && isChar(s, vr.open-1, ' ') {
+					// "a ${x} b" -> "a b", "a ${x} ${y}" -> "a"
+					prefixEnd--
+				} else if isChar(s, varEndPos, ' ') && b.Len()+vr.open-oldIdx == 0 {
+					// "${x} b" -> "b", "${x} ${y} b" -> "b"
+					varEndPos++
+				}
+			}
+			b.WriteString(s[oldIdx:prefixEnd])
+			if included != nil {
+				// variables left in the included text stay variables of the result
+				for _, inc := range included.varPositions {
+					cpVar := inc.clone()
+					cpVar.open += b.Len()
+					cpVar.close += b.Len()
+					missingVarPositions = append(missingVarPositions, cpVar)
+				}
+				for _, name := range included.vars {
+					missingVarMap[name] = true
+				}
+			}
 			b.WriteString(val)
 			oldIdx = varEndPos
 		}
@@ -203,24 +1098,261 @@ func (c *Template) apply(vars map[string]string, validateRequired bool, applyDef
 	// last
 	b.WriteString(s[oldIdx:])
 
+	if count != nil {
+		*count = b.n
+	}
 	return &Template{
-		template:     b.String(),
+		template:     b.b.String(),
 		varPositions: missingVarPositions,
 		vars:         getVars(missingVarMap),
+		bindings:     c.bindings,
+		aliases:      c.aliases,
+		validators:   c.validators,
+		compileOpts:  c.compileOpts,
 	}, nil
 }
 
+// expandList splits a list value and joins it back with the same separator,
+// dropping duplicates for :+. An empty value is an empty list.
+func expandList(val string, vr *varAndPosition, opts *ApplyOptions) string {
+	sep := vr.listSeparator
+	if sep == "" {
+		sep = opts.ListSeparator
+	}
+	if sep == "" {
+		sep = ","
+	}
+	items := strings.Split(val, sep)
+	if vr.repeatMode == repeatMode_Uniq {
+		seen := make(map[string]bool, len(items))
+		uniq := items[:0]
+		for _, item := range items {
+			if !seen[item] {
+				seen[item] = true
+				uniq = append(uniq, item)
+			}
+		}
+		items = uniq
+	}
+	return strings.Join(items, sep)
+}
+
+// listItem selects the item of the list value at the index of vr
+func listItem(val string, vr *varAndPosition, opts *ApplyOptions) (string, error) {
+	sep := opts.ListSeparator
+	if sep == "" {
+		sep = ","
+	}
+	var items []string
+	if val != "" {
+		items = strings.Split(val, sep)
+	}
+	idx := vr.listIndex
+	if idx < 0 {
+		idx += len(items)
+	}
+	if idx < 0 || idx >= len(items) {
+		return "", fmt.Errorf("variable %s: index %d out of range for %d items", vr.display(), vr.listIndex, len(items))
+	}
+	return items[idx], nil
+}
+
+// clampNumber parses val as an integer and clamps it into the range of vr
+func clampNumber(val string, vr *varAndPosition, errorOnClamp bool) (string, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("variable %s: %q is not a number", vr.display(), val)
+	}
+	if n >= vr.clampMin && n <= vr.clampMax {
+		return strconv.FormatInt(n, 10), nil
+	}
+	if errorOnClamp {
+		return "", fmt.Errorf("variable %s: %d is out of range [%d, %d]", vr.display(), n, vr.clampMin, vr.clampMax)
+	}
+	if n < vr.clampMin {
+		n = vr.clampMin
+	} else {
+		n = vr.clampMax
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// PreviewMacros resolves each macro of the template once, like apply
+// would with opts, without touching variables. Unknown macros map to
+// their fallback; macros that fail or have no fallback are left out
+func (c *Template) PreviewMacros(opts *ApplyOptions) map[string]string {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	values := make(map[string]string)
+	for _, vr := range c.varPositions {
+		if !vr.isMacro {
+			continue
+		}
+		if _, ok := values[vr.varName]; ok {
+			continue
+		}
+		val, ok, err := lookupMacro(vr.varName, opts)
+		if err != nil {
+			continue
+		}
+		if !ok && vr.hasDefaultValue {
+			val, ok = vr.defaultValue, true
+		}
+		if ok {
+			values[vr.varName] = val
+		}
+	}
+	return values
+}
+
+// rejoin splits val on sep and joins the items with with. Items are
+// trimmed and empty ones, e.g. from a trailing separator, are dropped
+func rejoin(val string, sep string, with string) string {
+	parts := strings.Split(val, sep)
+	items := parts[:0]
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			items = append(items, p)
+		}
+	}
+	return strings.Join(items, with)
+}
+
+// lookupMacro resolves a macro through opts.MacroResolver, then the builtins
+func lookupMacro(name string, opts *ApplyOptions) (string, bool, error) {
+	if opts.MacroResolver != nil {
+		if macro, found := opts.MacroResolver(strings.TrimPrefix(name, "@")); found {
+			val, err := macro()
+			if err != nil {
+				return "", false, fmt.Errorf("macro %s: %v", name, err)
+			}
+			return val, true, nil
+		}
+	}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	return resolveMacro(name, now)
+}
+
+// resolveMacro resolves a builtin macro, returns false if the macro is unknown
+func resolveMacro(name string, now func() time.Time) (string, bool, error) {
+	macro := strings.TrimPrefix(name, "@")
+	switch macro {
+	case "timestamp":
+		return strconv.FormatInt(now().Unix(), 10), true, nil
+	case "timestamp_ms":
+		return strconv.FormatInt(unixMilli(now()), 10), true, nil
+	case "timestamp_us":
+		return strconv.FormatInt(unixMicro(now()), 10), true, nil
+	case "timestamp_ns":
+		return strconv.FormatInt(now().UnixNano(), 10), true, nil
+	}
+	return "", false, nil
+}
+
+// RequiredVarError is returned when a required variable is missing
+type RequiredVarError struct {
+	Name   string // raw spec like name!, *** for secret variables
+	Offset int    // byte offset of the variable in Template()
+	Line   int    // 1-based line of the variable
+	Column int    // 1-based column of the variable, counted in runes
+}
+
+func (e *RequiredVarError) Error() string {
+	return fmt.Sprintf("required variable %s is missing", e.Name)
+}
+
+// Position returns the 1-based line and rune column of a byte offset
+// in Template(), matching what editors display for multibyte text
+func (c *Template) Position(offset int) (line int, column int) {
+	return lineColumn(c.template, offset)
+}
+
+func lineColumn(s string, offset int) (line int, column int) {
+	if offset > len(s) {
+		offset = len(s)
+	}
+	before := s[:offset]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return strings.Count(before, "\n") + 1, utf8.RuneCountInString(before[lineStart:]) + 1
+}
+
+// extraVars returns the sorted keys of vars neither the template
+// nor its included templates reference
+func (c *Template) extraVars(vars map[string]string, included map[string]bool) []string {
+	var extra []string
+	for _, name := range sortedKeys(vars) {
+		i := sort.SearchStrings(c.vars, name)
+		if (i == len(c.vars) || c.vars[i] != name) && !included[name] && !c.isAliasTarget(name) {
+			extra = append(extra, name)
+		}
+	}
+	return extra
+}
+
+// lookupVar returns the value of name in vars, or of its canonical name if
+// name is an alias missing from vars, along with the key it was found under
+func lookupVar(vars map[string]string, aliases map[string]string, name string) (val string, key string, ok bool) {
+	if val, ok = vars[name]; ok {
+		return val, name, true
+	}
+	if canonical, isAlias := aliases[name]; isAlias {
+		val, ok = vars[canonical]
+		return val, canonical, ok
+	}
+	return "", name, false
+}
+
+// isAliasTarget reports whether name is the canonical name of an alias
+func (c *Template) isAliasTarget(name string) bool {
+	for _, canonical := range c.aliases {
+		if canonical == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isTruthy reports whether a gate value enables its transform:
+// anything but empty, 0 and false
+func isTruthy(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
+
+// quoteShellStr single quotes s unless every character is in the safe set
+// [A-Za-z0-9._/-], an embedded single quote closes the quoting, is
+// escaped with a backslash and reopens it
 func quoteShellStr(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+	return singleQuote(s)
+}
+
+// quoteShellStrLoose only quotes s if it has whitespace or one of ;<>\${}()&!*
+func quoteShellStrLoose(s string) string {
 	if s == "" {
 		return "''"
 	}
 	if strings.ContainsAny(s, "\t \n;<>\\${}()&!*") { // special args
-		s = strings.ReplaceAll(s, "'", "'\\''")
-		return "'" + s + "'"
+		return singleQuote(s)
 	}
 	return s
 }
 
+const shellSafeChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._/-"
+
+func singleQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
+
 // isDollarSyntax checks if a variable at the given position uses $name syntax
 func isDollarSyntax(s string, pos int) bool {
 	return pos < len(s) && s[pos] == '$' && (pos+1 >= len(s) || s[pos+1] != '{')
@@ -239,18 +1371,426 @@ func isChar(s string, idx int, ch byte) bool {
 	return idx >= 0 && idx < len(s) && s[idx] == ch
 }
 
+// Bind returns a copy of the template that records a value for name
+// without rendering it. Bindings are materialized at Execute, where
+// they are overridden by the vars passed in. Last binding for a name wins.
+func (c *Template) Bind(name string, value string) *Template {
+	bindings := make(map[string]string, len(c.bindings)+1)
+	for k, v := range c.bindings {
+		bindings[k] = v
+	}
+	bindings[name] = value
+
+	t := c.clone()
+	t.bindings = bindings
+	return t
+}
+
+// WithAlias returns a copy of the template in which a variable named
+// alias missing from vars takes the value of canonical, e.g. to keep a
+// legacy name working during a migration. A value given for alias itself
+// wins. Aliases resolve one level only, canonical is not looked up as an alias
+func (c *Template) WithAlias(alias string, canonical string) *Template {
+	aliases := make(map[string]string, len(c.aliases)+1)
+	for k, v := range c.aliases {
+		aliases[k] = v
+	}
+	aliases[alias] = canonical
+
+	t := c.clone()
+	t.aliases = aliases
+	return t
+}
+
+// WithValidators returns a copy of the template that checks the resolved
+// value of each named variable after directives are applied, a failing
+// validator aborts rendering with an error naming the variable
+func (c *Template) WithValidators(validators map[string]func(value string) error) *Template {
+	merged := make(map[string]func(value string) error, len(c.validators)+len(validators))
+	for name, validate := range c.validators {
+		merged[name] = validate
+	}
+	for name, validate := range validators {
+		merged[name] = validate
+	}
+
+	t := c.clone()
+	t.validators = merged
+	return t
+}
+
+// WithDefault returns a copy of the template in which every occurrence of
+// the named variable has value as its ?: default, replacing any default
+// written in the template. The template text is left as is
+func (c *Template) WithDefault(name string, value string) *Template {
+	varPositions := make([]*varAndPosition, len(c.varPositions))
+	for i, vr := range c.varPositions {
+		if vr.varName == name {
+			vr = vr.clone()
+			vr.hasDefaultValue = true
+			vr.defaultValue = value
+			vr.defaultExpr = nil
+			vr.defaultTemplate = nil
+		}
+		varPositions[i] = vr
+	}
+
+	t := c.clone()
+	t.varPositions = varPositions
+	// variables referenced only by the replaced defaults are gone
+	t.vars = collectVars(varPositions)
+	return t
+}
+
+// requiredGroup is a set of variables of which at least one,
+// or exactly one, must be given
+type requiredGroup struct {
+	names      []string
+	exactlyOne bool
+}
+
+// WithRequiredGroup returns a copy of the template that fails to
+// execute unless at least one of names is given in vars or bindings.
+// Groups are not kept by PartialApply, whose vars are already consumed
+func (c *Template) WithRequiredGroup(names ...string) *Template {
+	return c.withRequiredGroup(requiredGroup{names: names})
+}
+
+// WithExclusiveGroup is like WithRequiredGroup but exactly one of names
+// must be given, e.g. either ${token} or ${password}
+func (c *Template) WithExclusiveGroup(names ...string) *Template {
+	return c.withRequiredGroup(requiredGroup{names: names, exactlyOne: true})
+}
+
+func (c *Template) withRequiredGroup(g requiredGroup) *Template {
+	g.names = append([]string(nil), g.names...)
+	t := c.clone()
+	t.requiredGroups = append(append([]requiredGroup(nil), c.requiredGroups...), g)
+	return t
+}
+
+// checkRequiredGroups validates the required groups against the given vars
+func (c *Template) checkRequiredGroups(vars map[string]string) error {
+	for _, g := range c.requiredGroups {
+		var given []string
+		for _, name := range g.names {
+			if _, _, ok := lookupVar(vars, c.aliases, name); ok {
+				given = append(given, name)
+			}
+		}
+		if len(given) == 0 {
+			return fmt.Errorf("one of %v is required", g.names)
+		}
+		if g.exactlyOne && len(given) > 1 {
+			return fmt.Errorf("only one of %v may be given, got %v", g.names, given)
+		}
+	}
+	return nil
+}
+
 // Execute will format the value, apply defaults and validate required variables
 func (c *Template) Execute(vars map[string]string) (string, error) {
-	t, err := c.apply(vars, true, true, true)
+	return c.execute(vars, &ApplyOptions{
+		ApplyDefault:     true,
+		ApplyMacro:       true,
+		ValidateRequired: true,
+	})
+}
+
+// ValidatesAsJSON renders the template like Execute and checks that the
+// result is valid JSON, e.g. in CI for config templates. Variables missing
+// from sampleVars get a dummy value: 0 for :%d variables, x otherwise.
+// A syntax error reports its line and column in the rendered output
+func (c *Template) ValidatesAsJSON(sampleVars map[string]string) error {
+	result, err := c.execute(sampleVars, &ApplyOptions{
+		ApplyDefault:     true,
+		ApplyMacro:       true,
+		ValidateRequired: true,
+		MissingValue: func(v Var) (string, bool) {
+			if v.IsNumber() {
+				return "0", true
+			}
+			return "x", true
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(result), &value); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			// Offset counts the bytes read including the offending one
+			offset := int(syntaxErr.Offset) - 1
+			if offset < 0 {
+				offset = 0
+			}
+			line, column := lineColumn(result, offset)
+			return fmt.Errorf("invalid JSON at line %d, column %d: %v", line, column, err)
+		}
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// ExecuteOrDefault is like Execute but returns fallback if rendering
+// fails, e.g. on a missing required variable. The error is swallowed,
+// use it only for non-critical text such as log lines
+func (c *Template) ExecuteOrDefault(vars map[string]string, fallback string) string {
+	result, err := c.Execute(vars)
+	if err != nil {
+		return fallback
+	}
+	return result
+}
+
+// ExecuteForm renders the template as &-separated k=v pairs and parses
+// them with url.ParseQuery. Values that may contain & or = should use
+// the :urlencode directive, like q=${query:urlencode}
+func (c *Template) ExecuteForm(vars map[string]string) (url.Values, error) {
+	result, err := c.Execute(vars)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(result)
+}
+
+// ExecutePairs renders the template as newline-separated KEY=VALUE records,
+// like an env file, see ExecutePairsSep
+func (c *Template) ExecutePairs(vars map[string]string) ([][2]string, error) {
+	return c.ExecutePairsSep(vars, "\n", "=")
+}
+
+// ExecutePairsSep renders the template, splits the result into records on
+// recordSep and each record into a key and a value on the first fieldSep.
+// Blank records are skipped, a record without fieldSep is an error
+func (c *Template) ExecutePairsSep(vars map[string]string, recordSep string, fieldSep string) ([][2]string, error) {
+	if recordSep == "" || fieldSep == "" {
+		return nil, fmt.Errorf("empty separator")
+	}
+	result, err := c.Execute(vars)
+	if err != nil {
+		return nil, err
+	}
+	var pairs [][2]string
+	for i, record := range strings.Split(result, recordSep) {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		idx := strings.Index(record, fieldSep)
+		if idx < 0 {
+			return nil, fmt.Errorf("record %d: missing %q: %s", i+1, fieldSep, record)
+		}
+		pairs = append(pairs, [2]string{record[:idx], record[idx+len(fieldSep):]})
+	}
+	return pairs, nil
+}
+
+// ExecuteToFile renders the template and atomically replaces path with
+// the result through a temporary file in the same directory.
+// Nothing is written if rendering fails
+func (c *Template) ExecuteToFile(path string, vars map[string]string, perm os.FileMode) error {
+	result, err := c.Execute(vars)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	_, err = f.WriteString(result)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// ExecuteWithOptions renders like Execute, with bindings and required
+// groups, but with the given options, e.g. ApplyMacro false to leave
+// macros for a later stage. Nil options are the defaults of Execute
+func (c *Template) ExecuteWithOptions(vars map[string]string, opts *ApplyOptions) (string, error) {
+	if opts == nil {
+		return c.Execute(vars)
+	}
+	return c.execute(vars, opts)
+}
+
+// ExecuteKV is like Execute with vars given as alternating keys and
+// values, e.g. ExecuteKV("name", "World"). An odd count is an error
+func (c *Template) ExecuteKV(kv ...string) (string, error) {
+	if len(kv)%2 != 0 {
+		return "", fmt.Errorf("odd number of key/value arguments: %d", len(kv))
+	}
+	vars := make(map[string]string, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		vars[kv[i]] = kv[i+1]
+	}
+	return c.Execute(vars)
+}
+
+// ExecuteWithUsed is like Execute but also returns the sorted names
+// of the variables whose value came from vars, not from defaults or macros,
+// including those read by computed defaults like ${t?:${b}*2}.
+// A variable resolved through an alias is reported by its canonical name
+func (c *Template) ExecuteWithUsed(vars map[string]string) (result string, used []string, err error) {
+	vars, err = c.executeVars(vars)
+	if err != nil {
+		return "", nil, err
+	}
+	usedMap := make(map[string]bool)
+	t, err := c.apply(vars, &ApplyOptions{
+		ApplyDefault:     true,
+		ApplyMacro:       true,
+		ValidateRequired: true,
+		onUse: func(key string) {
+			usedMap[key] = true
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return t.template, getVars(usedMap), nil
+}
+
+// RenderStats describes the output of a single render
+type RenderStats struct {
+	// SubstitutionCount is the number of variables that were replaced
+	SubstitutionCount int
+	// OutputBytes is the length of the rendered output
+	OutputBytes int
+	// DeltaBytes is OutputBytes minus the length of the source template,
+	// negative when substitutions removed more than they added
+	DeltaBytes int
+}
+
+// ExecuteWithStats is like Execute but also reports how many variables
+// were substituted and how the output size compares to the source
+func (c *Template) ExecuteWithStats(vars map[string]string) (string, RenderStats, error) {
+	var stats RenderStats
+	result, err := c.execute(vars, &ApplyOptions{
+		ApplyDefault:     true,
+		ApplyMacro:       true,
+		ValidateRequired: true,
+		OnSubstitute: func(name string, source SubstitutionSource, value string) {
+			stats.SubstitutionCount++
+		},
+	})
+	if err != nil {
+		return "", RenderStats{}, err
+	}
+	stats.OutputBytes = len(result)
+	stats.DeltaBytes = len(result) - len(c.template)
+	return result, stats, nil
+}
+
+// execute renders the template with bindings merged under vars
+func (c *Template) execute(vars map[string]string, opts *ApplyOptions) (string, error) {
+	vars, err := c.executeVars(vars)
+	if err != nil {
+		return "", err
+	}
+	t, err := c.apply(vars, opts)
 	if err != nil {
 		return "", err
 	}
 	return t.template, nil
 }
 
+// executeVars merges bindings under vars and checks the required groups
+func (c *Template) executeVars(vars map[string]string) (map[string]string, error) {
+	if len(c.bindings) > 0 {
+		merged := make(map[string]string, len(c.bindings)+len(vars))
+		for k, v := range c.bindings {
+			merged[k] = v
+		}
+		for k, v := range vars {
+			merged[k] = v
+		}
+		vars = merged
+	}
+	if err := c.checkRequiredGroups(vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// RenderedLen returns the length in bytes of what Execute would render,
+// e.g. for a Content-Length header, without building the output.
+// It fails like Execute. Macros, :file and :bash are evaluated, so the
+// length of a template using them may differ from a later Execute
+func (c *Template) RenderedLen(vars map[string]string) (int, error) {
+	vars, err := c.executeVars(vars)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	_, err = c.render(vars, &ApplyOptions{
+		ApplyDefault:     true,
+		ApplyMacro:       true,
+		ValidateRequired: true,
+	}, &n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// MergeVars returns a new map with the entries of all maps, later maps
+// override earlier ones. Inputs are never modified and may be nil
+func MergeVars(maps ...map[string]string) map[string]string {
+	n := 0
+	for _, m := range maps {
+		n += len(m)
+	}
+	merged := make(map[string]string, n)
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
 // stable sorted
 func getVars(varMap map[string]bool) []string {
-	vars := make([]string, 0, len(varMap))
+	return appendVars(make([]string, 0, len(varMap)), varMap)
+}
+
+// collectVars returns the sorted names of the variables at positions
+// and of the variables they reference
+func collectVars(positions []*varAndPosition) []string {
+	varMap := make(map[string]bool)
+	for _, vr := range positions {
+		varMap[vr.varName] = true
+		for _, name := range vr.refs() {
+			varMap[name] = true
+		}
+	}
+	return getVars(varMap)
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appendVars appends the sorted names of varMap to vars
+func appendVars(vars []string, varMap map[string]bool) []string {
 	for v := range varMap {
 		vars = append(vars, v)
 	}
@@ -1,6 +1,8 @@
 package var_template
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -41,6 +43,29 @@ func BenchmarkTemplatePartialApply(b *testing.B) {
 	}
 }
 
+func BenchmarkExecuteEmpty(b *testing.B) {
+	tmpl := Compile("")
+
+	if allocs := testing.AllocsPerRun(100, func() { tmpl.Execute(nil) }); allocs != 0 {
+		b.Fatalf("Execute() of an empty template allocates %v times", allocs)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmpl.Execute(nil)
+	}
+}
+
+func BenchmarkCompileLiteral(b *testing.B) {
+	template := strings.Repeat("a long static log prefix without variables, ", 50)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Compile(template)
+	}
+}
+
 func BenchmarkParseVarName(b *testing.B) {
 	varName := "name!?:John:%d"
 
@@ -59,3 +84,56 @@ func BenchmarkMacroExecution(b *testing.B) {
 		tmpl.Execute(map[string]string{})
 	}
 }
+
+func BenchmarkTemplateReset(b *testing.B) {
+	template := "Hello ${name}, you are ${age:%d} years old and live in ${city?:Unknown}"
+	tmpl := Compile(template)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmpl.Reset(template)
+	}
+}
+
+func manyVarsTemplate() (string, map[string]string) {
+	var b strings.Builder
+	vars := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		name := "v" + strconv.Itoa(i)
+		b.WriteString("key_" + name + " = ${" + name + "}\n")
+		vars[name] = "value" + strconv.Itoa(i)
+	}
+	return b.String(), vars
+}
+
+func BenchmarkExecuteManyVars(b *testing.B) {
+	template, vars := manyVarsTemplate()
+	tmpl := Compile(template)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmpl.Execute(vars)
+	}
+}
+
+func BenchmarkCompileRepeated(b *testing.B) {
+	template, _ := manyVarsTemplate()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Compile(template)
+	}
+}
+
+func BenchmarkCompileCachedRepeated(b *testing.B) {
+	template, _ := manyVarsTemplate()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CompileCached(template)
+	}
+}
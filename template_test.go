@@ -1,10 +1,16 @@
 package var_template
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -690,6 +696,36 @@ func TestDollarSyntaxSeparators(t *testing.T) {
 			vars:     map[string]string{"name_suffix": "value"},
 			want:     "value",
 		},
+		{
+			name:     "trailing underscore at end",
+			template: "$name_",
+			vars:     map[string]string{"name": "wrong", "name_": "value"},
+			want:     "value",
+		},
+		{
+			name:     "trailing underscore before separator",
+			template: "$name_.ext",
+			vars:     map[string]string{"name": "wrong", "name_": "value"},
+			want:     "value.ext",
+		},
+		{
+			name:     "doubled underscore",
+			template: "$name__var",
+			vars:     map[string]string{"name": "wrong", "name__var": "value"},
+			want:     "value",
+		},
+		{
+			name:     "underscore only",
+			template: "$_.ext",
+			vars:     map[string]string{"_": "value"},
+			want:     "value.ext",
+		},
+		{
+			name:     "brace form ends name before underscore",
+			template: "${name}_.ext",
+			vars:     map[string]string{"name": "value"},
+			want:     "value_.ext",
+		},
 		{
 			name:     "multiple separators",
 			template: "$name.ext and $other-file",
@@ -1072,3 +1108,2948 @@ func stringSliceEqual(a, b []string) bool {
 	}
 	return true
 }
+
+func TestSecretDirective(t *testing.T) {
+	tmpl := Compile("token=${token!:secret}")
+	if tmpl.NumVars() != 1 || !tmpl.Var(0).Secret() {
+		t.Fatalf("expected one secret variable")
+	}
+
+	got, err := tmpl.Execute(map[string]string{"token": "s3cr3t"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got != "token=s3cr3t" {
+		t.Errorf("Execute() = %q, want %q", got, "token=s3cr3t")
+	}
+
+	_, err = tmpl.Execute(map[string]string{})
+	if err == nil {
+		t.Fatal("expected error for missing required secret")
+	}
+	if strings.Contains(err.Error(), "token") || !strings.Contains(err.Error(), "***") {
+		t.Errorf("error should be redacted, got: %v", err)
+	}
+	if raw := tmpl.GetGetRaw("token"); raw != "***" {
+		t.Errorf("GetGetRaw() = %q, want %q", raw, "***")
+	}
+
+	dflt := Compile("${token?:fallback:secret}")
+	if got, _ := dflt.Execute(nil); got != "fallback" {
+		t.Errorf("Execute() = %q, want %q", got, "fallback")
+	}
+}
+
+func TestCompileStrict(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{name: "valid", template: "Hello ${name} $age", wantErr: false},
+		{name: "escaped", template: "Hello \\${name", wantErr: false},
+		{name: "unclosed", template: "Hello ${name", wantErr: true},
+		{name: "empty name", template: "Hello ${}", wantErr: true},
+		{name: "multiple directives", template: "${var:bash:shell_quote}", wantErr: true},
+		{name: "unknown directive", template: "${a:bogus}", wantErr: true},
+		{name: "long repeat separator", template: "${a:+ab}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileStrict(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CompileStrict() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMustCompile(t *testing.T) {
+	tmpl := MustCompile("Hello ${name}")
+	if got, _ := tmpl.Execute(map[string]string{"name": "World"}); got != "Hello World" {
+		t.Errorf("Execute() = %q, want %q", got, "Hello World")
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("MustCompile() should panic on unclosed variable")
+		}
+		if msg, _ := r.(string); !strings.Contains(msg, "unclosed variable") {
+			t.Errorf("panic message = %v, should contain the strict error", r)
+		}
+	}()
+	MustCompile("Hello ${name")
+}
+
+func TestConditionalSection(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{
+			name:     "value present",
+			template: "http://${host}${?port:::}/api",
+			vars:     map[string]string{"host": "localhost", "port": "8080"},
+			want:     "http://localhost:8080/api",
+		},
+		{
+			name:     "value missing",
+			template: "http://${host}${?port:::}/api",
+			vars:     map[string]string{"host": "localhost"},
+			want:     "http://localhost/api",
+		},
+		{
+			name:     "value empty",
+			template: "http://${host}${?port:::}/api",
+			vars:     map[string]string{"host": "localhost", "port": ""},
+			want:     "http://localhost/api",
+		},
+		{
+			name:     "query string",
+			template: "/search${?q::?q=}",
+			vars:     map[string]string{"q": "go"},
+			want:     "/search?q=go",
+		},
+		{
+			name:     "no text",
+			template: "[${?name}]",
+			vars:     map[string]string{},
+			want:     "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// partial application keeps the section for a later stage
+	partial := Compile("host${?port:::}").PartialApply(map[string]string{"other": "x"})
+	if partial.String() != "host${?port:::}" {
+		t.Errorf("PartialApply() = %q, want %q", partial.String(), "host${?port:::}")
+	}
+}
+
+func TestQuotedVariableNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantVars []string
+		wantErr  bool
+	}{
+		{
+			name:     "dotted name",
+			template: `Hello ${"user.name"}`,
+			vars:     map[string]string{"user.name": "John"},
+			want:     "Hello John",
+			wantVars: []string{"user.name"},
+		},
+		{
+			name:     "name with spaces",
+			template: `Hello ${" first name "}`,
+			vars:     map[string]string{" first name ": "John"},
+			want:     "Hello John",
+			wantVars: []string{" first name "},
+		},
+		{
+			name:     "quoted name with default",
+			template: `${"user.age"?:25:%d}`,
+			vars:     map[string]string{},
+			want:     "25",
+			wantVars: []string{"user.age"},
+		},
+		{
+			name:     "quoted required name",
+			template: `${"user.name"!}`,
+			vars:     map[string]string{},
+			wantVars: []string{"user.name"},
+			wantErr:  true,
+		},
+		{
+			name:     "closing brace in quotes",
+			template: `${"a}b"} ${"c}"?:x}`,
+			vars:     map[string]string{"a}b": "V"},
+			want:     "V x",
+			wantVars: []string{"a}b", "c}"},
+		},
+		{
+			name:     "text after quote",
+			template: `${"user"name}`,
+			vars:     map[string]string{},
+			want:     `${"user"name}`,
+			wantVars: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			if got := tmpl.Variables(); !stringSliceEqual(got, tt.wantVars) {
+				t.Errorf("Variables() = %v, want %v", got, tt.wantVars)
+			}
+			got, err := tmpl.Execute(tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAgainst(t *testing.T) {
+	tmpl := Compile("${host}:${port} ${@timestamp} $user ${debug?:false}")
+	if err := tmpl.ValidateAgainst([]string{"host", "port", "user", "debug"}); err != nil {
+		t.Errorf("ValidateAgainst() error = %v", err)
+	}
+	err := tmpl.ValidateAgainst([]string{"host"})
+	if err == nil {
+		t.Fatal("ValidateAgainst() should fail")
+	}
+	if want := "unknown variables: debug, port, user"; err.Error() != want {
+		t.Errorf("ValidateAgainst() error = %q, want %q", err.Error(), want)
+	}
+
+	// secret names stay out of the error
+	err = Compile("${db_password:secret} ${host} ${db_password}").ValidateAgainst(nil)
+	if want := "unknown variables: ***, host"; err == nil || err.Error() != want {
+		t.Errorf("ValidateAgainst() error = %v, want %q", err, want)
+	}
+}
+
+func TestTemplateReset(t *testing.T) {
+	tmpl := Compile("Hello ${name}, ${greeting} ${a} ${b}")
+	tmpl.Reset("Bye \\$skip $who")
+	if got := tmpl.Variables(); !stringSliceEqual(got, []string{"who"}) {
+		t.Errorf("Variables() = %v, want %v", got, []string{"who"})
+	}
+	if tmpl.NumVars() != 1 {
+		t.Errorf("NumVars() = %d, want 1", tmpl.NumVars())
+	}
+	got, err := tmpl.Execute(map[string]string{"who": "World"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got != "Bye $skip World" {
+		t.Errorf("Execute() = %q, want %q", got, "Bye $skip World")
+	}
+}
+
+func TestTemplateResetKeepsCopies(t *testing.T) {
+	orig := Compile("${a} ${b}")
+	copies := []*Template{orig.Bind("b", "B"), orig.WithAlias("x", "a")}
+	orig.Reset("${c}")
+	for _, tmpl := range copies {
+		if got := tmpl.Variables(); !stringSliceEqual(got, []string{"a", "b"}) {
+			t.Errorf("Variables() = %v, want [a b]", got)
+		}
+		got, err := tmpl.Execute(map[string]string{"a": "A", "b": "B", "c": "C"})
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		if got != "A B" {
+			t.Errorf("Execute() = %q, want %q", got, "A B")
+		}
+	}
+}
+
+func TestTemplateBind(t *testing.T) {
+	base := Compile("${greeting} ${name}!")
+	tmpl := base.Bind("greeting", "Hi").Bind("name", "John").Bind("greeting", "Hello")
+
+	got, err := tmpl.Execute(nil)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got != "Hello John!" {
+		t.Errorf("Execute() = %q, want %q", got, "Hello John!")
+	}
+
+	// vars passed to Execute override bindings
+	if got, _ := tmpl.Execute(map[string]string{"name": "Jane"}); got != "Hello Jane!" {
+		t.Errorf("Execute() = %q, want %q", got, "Hello Jane!")
+	}
+
+	// bindings stay deferred through PartialApply
+	partial := tmpl.PartialApply(map[string]string{"other": "x"})
+	if partial.String() != "${greeting} ${name}!" {
+		t.Errorf("PartialApply() = %q, bindings should not be rendered", partial.String())
+	}
+	if got, _ := partial.Execute(nil); got != "Hello John!" {
+		t.Errorf("Execute() = %q, want %q", got, "Hello John!")
+	}
+
+	// base template is not modified
+	if got, _ := base.Execute(nil); got != "${greeting} ${name}!" {
+		t.Errorf("Execute() = %q, want %q", got, "${greeting} ${name}!")
+	}
+
+	// Reset drops the state attached to the previous template
+	pooled := Compile("${a}").Bind("b", "x").WithAlias("b", "a").WithRequiredGroup("a").
+		WithValidators(map[string]func(string) error{"b": func(string) error { return fmt.Errorf("nope") }})
+	pooled.Reset("${b}")
+	if got, err := pooled.Execute(nil); err != nil || got != "${b}" {
+		t.Errorf("Execute() after Reset = %q, %v, want %q", got, err, "${b}")
+	}
+}
+
+func TestVarDirectives(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{template: "${name}", want: nil},
+		{template: "${age:%d}", want: []string{"%d"}},
+		{template: "${age?:25:%d}", want: []string{"%d"}},
+		{template: "${str:shell_quote}", want: []string{"shell_quote"}},
+		{template: "${echo hi:bash}", want: []string{"bash"}},
+		{template: "${path:file}", want: []string{"file"}},
+		{template: "${token!:secret}", want: []string{"secret"}},
+		{template: "${items:+}", want: []string{"+"}},
+		{template: "${@timestamp}", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			if tmpl.NumVars() != 1 {
+				t.Fatalf("NumVars() = %d, want 1", tmpl.NumVars())
+			}
+			if got := tmpl.Var(0).Directives(); !stringSliceEqual(got, tt.want) {
+				t.Errorf("Directives() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileAll(t *testing.T) {
+	compiled, err := CompileAll(map[string]string{
+		"greeting": "Hello ${name}",
+		"url":      "$scheme://$host",
+	})
+	if err != nil {
+		t.Fatalf("CompileAll() error = %v", err)
+	}
+	if got := compiled["url"].Variables(); !stringSliceEqual(got, []string{"host", "scheme"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+
+	_, err = CompileAll(map[string]string{
+		"ok":       "Hello ${name}",
+		"unclosed": "Hello ${name",
+		"empty":    "Hello ${}",
+	})
+	if err == nil {
+		t.Fatal("CompileAll() should fail")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "unclosed:") || !strings.Contains(msg, "empty:") || strings.Contains(msg, "ok:") {
+		t.Errorf("CompileAll() error = %v, should name every failing template", err)
+	}
+
+	compiled, err = CompileAllWithOptions(map[string]string{
+		"hyphen":   "$name-suffix",
+		"unclosed": "Hello ${name",
+	}, &CompileOptions{AllowHyphenInName: true})
+	if err != nil {
+		t.Fatalf("CompileAllWithOptions() error = %v", err)
+	}
+	if got := compiled["hyphen"].Variables(); !stringSliceEqual(got, []string{"name-suffix"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+	if _, err := CompileAllWithOptions(map[string]string{"long": "abc"}, &CompileOptions{MaxLength: 2}); err == nil || !strings.Contains(err.Error(), "long: template length 3 exceeds 2") {
+		t.Errorf("CompileAllWithOptions() error = %v, want length limit of long", err)
+	}
+}
+
+func TestVarKind(t *testing.T) {
+	tests := []struct {
+		template string
+		want     VarKind
+	}{
+		{template: "${name}", want: KindPlain},
+		{template: "$name", want: KindPlain},
+		{template: "${age?:1:%d}", want: KindNumber},
+		{template: "${@timestamp}", want: KindMacro},
+		{template: "${path:file}", want: KindFile},
+		{template: "${echo hi:bash}", want: KindBash},
+		{template: "${str:shell_quote}", want: KindShellQuote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if got := Compile(tt.template).Var(0).Kind(); got != tt.want {
+				t.Errorf("Kind() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnicodeVariableNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantVars []string
+	}{
+		{
+			name:     "brace unicode name",
+			template: "Bonjour ${café}",
+			vars:     map[string]string{"café": "noir"},
+			want:     "Bonjour noir",
+			wantVars: []string{"café"},
+		},
+		{
+			name:     "dollar unicode name",
+			template: "こんにちは $名前さん!",
+			vars:     map[string]string{"名前さん": "世界"},
+			want:     "こんにちは 世界!",
+			wantVars: []string{"名前さん"},
+		},
+		{
+			name:     "dollar unicode name with separator",
+			template: "$café.txt",
+			vars:     map[string]string{"café": "menu"},
+			want:     "menu.txt",
+			wantVars: []string{"café"},
+		},
+		{
+			name:     "unicode text after ascii name",
+			template: "$name→next",
+			vars:     map[string]string{"name": "a"},
+			want:     "a→next",
+			wantVars: []string{"name"},
+		},
+		{
+			name:     "dollar before symbol",
+			template: "cost: $€5",
+			vars:     map[string]string{},
+			want:     "cost: $€5",
+			wantVars: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			if got := tmpl.Variables(); !stringSliceEqual(got, tt.wantVars) {
+				t.Errorf("Variables() = %v, want %v", got, tt.wantVars)
+			}
+			got, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyOnSubstitute(t *testing.T) {
+	type call struct {
+		name   string
+		source SubstitutionSource
+		value  string
+	}
+	var calls []call
+	tmpl := Compile("${name} ${port?:80} ${token:secret} ${@unknown?:x} ${missing}")
+	got := tmpl.Apply(map[string]string{"name": "John", "token": "s3cr3t"}, &ApplyOptions{
+		ApplyDefault: true,
+		ApplyMacro:   true,
+		OnSubstitute: func(name string, source SubstitutionSource, value string) {
+			calls = append(calls, call{name, source, value})
+		},
+	})
+	if got.String() != "John 80 s3cr3t x ${missing}" {
+		t.Errorf("Apply() = %q", got.String())
+	}
+	want := []call{
+		{"name", SourceVars, "John"},
+		{"port", SourceDefault, "80"},
+		{"token", SourceVars, "***"},
+		{"@unknown", SourceDefault, "x"},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("OnSubstitute calls = %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("OnSubstitute call %d = %v, want %v", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestErrorOnUnknownMacro(t *testing.T) {
+	opts := &ApplyOptions{ApplyMacro: true, ErrorOnUnknownMacro: true}
+
+	_, err := Compile(`{"ts": "${@unknown}"}`).apply(nil, opts)
+	if err == nil || !strings.Contains(err.Error(), "unknown macro @unknown") {
+		t.Errorf("apply() error = %v, want unknown macro error", err)
+	}
+
+	for _, tpl := range []string{"${@timestamp}", "${@unknown?:0}"} {
+		if _, err := Compile(tpl).apply(nil, opts); err != nil {
+			t.Errorf("apply(%q) error = %v", tpl, err)
+		}
+	}
+
+	// lenient by default
+	got := Compile("${@unknown}").Apply(nil, &ApplyOptions{ApplyMacro: true})
+	if got.String() != "${@unknown}" {
+		t.Errorf("Apply() = %q, want %q", got.String(), "${@unknown}")
+	}
+}
+
+func TestCompileSprintf(t *testing.T) {
+	tmpl, err := CompileSprintf("user %s is %d years old, 100%% sure, costs $5 %v", "name", "age", "user.note")
+	if err != nil {
+		t.Fatalf("CompileSprintf() error = %v", err)
+	}
+	if got := tmpl.Variables(); !stringSliceEqual(got, []string{"age", "name", "user.note"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+	got, err := tmpl.Execute(map[string]string{"name": "john", "age": "25", "user.note": "ok"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if want := "user john is 25 years old, 100% sure, costs $5 ok"; got != want {
+		t.Errorf("Execute() = %q, want %q", got, want)
+	}
+
+	price, err := CompileSprintf("$%s", "amount")
+	if err != nil {
+		t.Fatalf("CompileSprintf() error = %v", err)
+	}
+	if got, _ := price.Execute(map[string]string{"amount": "5"}); got != "$5" {
+		t.Errorf("Execute() = %q, want %q", got, "$5")
+	}
+
+	errCases := []struct {
+		format string
+		names  []string
+	}{
+		{format: "%s %s", names: []string{"a"}},
+		{format: "%s", names: []string{"a", "b"}},
+		{format: "%x", names: []string{"a"}},
+		{format: "50%", names: nil},
+		{format: `\%s`, names: []string{"a"}},
+	}
+	for _, tt := range errCases {
+		if _, err := CompileSprintf(tt.format, tt.names...); err == nil {
+			t.Errorf("CompileSprintf(%q, %v) should fail", tt.format, tt.names)
+		}
+	}
+}
+
+func TestLiteralSize(t *testing.T) {
+	tests := []struct {
+		template string
+		want     int
+	}{
+		{template: "", want: 0},
+		{template: "Hello World", want: 11},
+		{template: "Hello ${name}!", want: 7},
+		{template: "$host:$port", want: 1},
+		{template: "\\${escaped} ${a?:default}", want: 11},
+	}
+	for _, tt := range tests {
+		if got := Compile(tt.template).LiteralSize(); got != tt.want {
+			t.Errorf("LiteralSize(%q) = %d, want %d", tt.template, got, tt.want)
+		}
+	}
+
+	tmpl := Compile("Hello ${name}, ${missing}")
+	if got, want := tmpl.estimateSize(map[string]string{"name": "World"}), len("Hello World, ${missing}"); got != want {
+		t.Errorf("estimateSize() = %d, want %d", got, want)
+	}
+}
+
+func TestDisableNumberUnquote(t *testing.T) {
+	tmpl := Compile(`{"zip": "${zip:%d}"}`)
+	opts := &ApplyOptions{DisableNumberUnquote: true}
+
+	got, err := tmpl.apply(map[string]string{"zip": "02134"}, opts)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if want := `{"zip": "02134"}`; got.String() != want {
+		t.Errorf("apply() = %q, want %q", got.String(), want)
+	}
+
+	if _, err := tmpl.apply(map[string]string{"zip": "abc"}, opts); err == nil {
+		t.Error("apply() should reject a non-number value")
+	}
+	// surrounding spaces are accepted, as with NumberFormat
+	if _, err := tmpl.apply(map[string]string{"zip": " 02134 "}, opts); err != nil {
+		t.Errorf("apply() error = %v", err)
+	}
+
+	// unquoting stays the default
+	if got, _ := tmpl.Execute(map[string]string{"zip": "02134"}); got != `{"zip": 02134}` {
+		t.Errorf("Execute() = %q", got)
+	}
+}
+
+func TestUnclosedBraceError(t *testing.T) {
+	_, err := CompileStrict("Hello ${name} and ${other")
+	var unclosed *UnclosedBraceError
+	if !errors.As(err, &unclosed) {
+		t.Fatalf("CompileStrict() error = %v, want *UnclosedBraceError", err)
+	}
+	if unclosed.Offset != 18 {
+		t.Errorf("Offset = %d, want 18", unclosed.Offset)
+	}
+}
+
+func TestRepeatModeListSeparator(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		sep      string
+		want     string
+	}{
+		{name: "uniq default separator", template: "${items:+}", vars: map[string]string{"items": "a,b,a,c,b"}, want: "a,b,c"},
+		{name: "any keeps all", template: "${items:*}", vars: map[string]string{"items": "a,b,a"}, want: "a,b,a"},
+		{name: "option separator", template: "${items:+}", vars: map[string]string{"items": "a b a"}, sep: " ", want: "a b"},
+		{name: "per variable separator wins", template: "${items:+;}", vars: map[string]string{"items": "a,b;a,b;c"}, sep: " ", want: "a,b;c"},
+		{name: "empty value", template: "[${items:+}]", vars: map[string]string{"items": ""}, want: "[]"},
+		{name: "default value", template: "${items?:x,x:+}", vars: map[string]string{}, want: "x"},
+		{name: "plus in default", template: "${dial?:tel:+15551234}", vars: map[string]string{}, want: "tel:+15551234"},
+		{name: "star in default", template: "${glob?:src:*.go}", vars: map[string]string{}, want: "src:*.go"},
+		{name: "offset in default", template: "${tz?:UTC:+0800}", vars: map[string]string{}, want: "UTC:+0800"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileStrict(tt.template); err != nil {
+				t.Fatalf("CompileStrict() error = %v", err)
+			}
+			got, err := Compile(tt.template).apply(tt.vars, &ApplyOptions{ApplyDefault: true, ListSeparator: tt.sep})
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("apply() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRawSpan(t *testing.T) {
+	tmpl := Compile("\\$x ${ name!?:a } and $host:$port")
+	want := []struct {
+		start, end int
+		text       string
+	}{
+		{3, 16, "${ name!?:a }"},
+		{21, 26, "$host"},
+		{27, 32, "$port"},
+	}
+	if tmpl.NumVars() != len(want) {
+		t.Fatalf("NumVars() = %d, want %d", tmpl.NumVars(), len(want))
+	}
+	for i, w := range want {
+		start, end, text := tmpl.RawSpan(i)
+		if start != w.start || end != w.end || text != w.text {
+			t.Errorf("RawSpan(%d) = %d, %d, %q, want %d, %d, %q", i, start, end, text, w.start, w.end, w.text)
+		}
+	}
+}
+
+func TestEnvFallbackChain(t *testing.T) {
+	tmpl := Compile("${port:env:VAR_TEMPLATE_TEST_PORT?:8080}")
+	if got := tmpl.Variables(); !stringSliceEqual(got, []string{"port"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+	if got := tmpl.Var(0).Directives(); !stringSliceEqual(got, []string{"env:VAR_TEMPLATE_TEST_PORT"}) {
+		t.Errorf("Directives() = %v", got)
+	}
+
+	tests := []struct {
+		name string
+		vars map[string]string
+		env  string
+		want string
+	}{
+		{name: "supplied", vars: map[string]string{"port": "1"}, env: "2", want: "1"},
+		{name: "env set", vars: map[string]string{}, env: "2", want: "2"},
+		{name: "default", vars: map[string]string{}, want: "8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("VAR_TEMPLATE_TEST_PORT", tt.env)
+			}
+			got, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		_, err := Compile("${port!:env:VAR_TEMPLATE_TEST_PORT:%d}").Execute(nil)
+		if err == nil {
+			t.Error("Execute() should fail for missing required variable")
+		}
+	})
+}
+
+func TestApplyMissingValue(t *testing.T) {
+	tmpl := Compile("${name!} ${port?:80} ${skip} ${@unknown}")
+	got, err := tmpl.apply(map[string]string{}, &ApplyOptions{
+		ApplyDefault:     true,
+		ApplyMacro:       true,
+		ValidateRequired: true,
+		MissingValue: func(v Var) (string, bool) {
+			if v.Name() == "skip" {
+				return "", false
+			}
+			return "<" + v.Name() + ">", true
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if want := "<name> 80 ${skip} ${@unknown}"; got.String() != want {
+		t.Errorf("apply() = %q, want %q", got.String(), want)
+	}
+	if got := got.Variables(); !stringSliceEqual(got, []string{"@unknown", "skip"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := Compile("Hello ${name?:World}")
+	if a.Fingerprint() != Compile("Hello ${name?:World}").Fingerprint() {
+		t.Error("Fingerprint() should be equal for the same source")
+	}
+	// stable across runs
+	if got := Compile("Hello ${name}").Fingerprint(); got != 0xc32e58903226520f {
+		t.Errorf("Fingerprint() = %#x, want %#x", got, uint64(0xc32e58903226520f))
+	}
+	for _, other := range []*Template{
+		Compile("Hello ${name?:Go}"),
+		Compile("Hello ${name}"),
+		a.Bind("name", "John"),
+	} {
+		if other.Fingerprint() == a.Fingerprint() {
+			t.Errorf("Fingerprint() of %q should differ", other.String())
+		}
+	}
+}
+
+func TestHTMLDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{
+			name:     "escape value",
+			template: "<p>${msg:html}</p>",
+			vars:     map[string]string{"msg": `<script>alert("x" & 'y')</script>`},
+			want:     "<p>&lt;script&gt;alert(&#34;x&#34; &amp; &#39;y&#39;)&lt;/script&gt;</p>",
+		},
+		{
+			name:     "escape default",
+			template: "<b>${title?:Tom & Jerry:html}</b>",
+			vars:     map[string]string{},
+			want:     "<b>Tom &amp; Jerry</b>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClampDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{name: "in range", template: `{"workers": "${workers:clamp:1:64:%d}"}`, vars: map[string]string{"workers": "8"}, want: `{"workers": 8}`},
+		{name: "above max", template: `{"workers": "${workers:clamp:1:64}"}`, vars: map[string]string{"workers": "100"}, want: `{"workers": 64}`},
+		{name: "below min", template: "${workers:clamp:1:64}", vars: map[string]string{"workers": "-3"}, want: "1"},
+		{name: "default clamped", template: "${workers?:0:clamp:1:64}", vars: map[string]string{}, want: "1"},
+		{name: "not a number", template: "${workers:clamp:1:64}", vars: map[string]string{"workers": "many"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).Execute(tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := Compile("${w:clamp:1:64:%d}").Var(0).Directives(); !stringSliceEqual(got, []string{"clamp:1:64", "%d"}) {
+		t.Errorf("Directives() = %v", got)
+	}
+	if _, err := CompileStrict("${w:clamp:64:1}"); err == nil {
+		t.Error("CompileStrict() should reject min > max")
+	}
+	_, err := Compile("${w:clamp:1:64}").apply(map[string]string{"w": "65"}, &ApplyOptions{ErrorOnClamp: true})
+	if err == nil {
+		t.Error("apply() should fail with ErrorOnClamp")
+	}
+}
+
+func TestExecuteWithUsed(t *testing.T) {
+	tmpl := Compile("${name} ${name} ${port?:80} ${host?:localhost} ${@timestamp} ${?q::?} ${missing}")
+	result, used, err := tmpl.ExecuteWithUsed(map[string]string{
+		"name":   "John",
+		"host":   "example.com",
+		"unused": "x",
+	})
+	if err != nil {
+		t.Fatalf("ExecuteWithUsed() error = %v", err)
+	}
+	if !strings.HasPrefix(result, "John John 80 example.com ") {
+		t.Errorf("ExecuteWithUsed() result = %q", result)
+	}
+	if want := []string{"host", "name"}; !stringSliceEqual(used, want) {
+		t.Errorf("ExecuteWithUsed() used = %v, want %v", used, want)
+	}
+
+	// a gate is used when it is consulted
+	_, used, err = Compile("${p:shell_quote_if:q}").ExecuteWithUsed(map[string]string{"p": "a b", "q": "1"})
+	if err != nil || !stringSliceEqual(used, []string{"p", "q"}) {
+		t.Errorf("ExecuteWithUsed() used = %v, %v, want [p q]", used, err)
+	}
+}
+
+func TestDollarParenBoundary(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantVars []string
+	}{
+		{
+			name:     "concatenated word",
+			template: "$(name)x",
+			vars:     map[string]string{"name": "a", "namex": "wrong"},
+			want:     "ax",
+			wantVars: []string{"name"},
+		},
+		{
+			name:     "macro",
+			template: "id-$(@timestamp)0",
+			vars:     map[string]string{},
+			wantVars: []string{"@timestamp"},
+		},
+		{
+			name:     "missing keeps text",
+			template: "$(name)x",
+			vars:     map[string]string{},
+			want:     "$(name)x",
+			wantVars: []string{"name"},
+		},
+		{
+			name:     "unclosed paren is literal",
+			template: "$(name x",
+			vars:     map[string]string{"name": "a"},
+			want:     "$(name x",
+			wantVars: []string{},
+		},
+		{
+			name:     "shell command is literal",
+			template: "$(date +%s) $((1+2))",
+			vars:     map[string]string{},
+			want:     "$(date +%s) $((1+2))",
+			wantVars: []string{},
+		},
+		{
+			name:     "escaped",
+			template: "\\$(name)",
+			vars:     map[string]string{"name": "a"},
+			want:     "$(name)",
+			wantVars: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			if got := tmpl.Variables(); !stringSliceEqual(got, tt.wantVars) {
+				t.Errorf("Variables() = %v, want %v", got, tt.wantVars)
+			}
+			got, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithValidators(t *testing.T) {
+	tmpl := Compile("user=${user:shell_quote} port=${port?:80}").WithValidators(map[string]func(string) error{
+		"user": func(v string) error {
+			if strings.Contains(v, "'") {
+				return errors.New("must not need quoting")
+			}
+			return nil
+		},
+		"port": func(v string) error {
+			if _, err := strconv.Atoi(v); err != nil {
+				return errors.New("must be a number")
+			}
+			return nil
+		},
+	})
+
+	got, err := tmpl.Execute(map[string]string{"user": "john"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got != "user=john port=80" {
+		t.Errorf("Execute() = %q", got)
+	}
+
+	// runs on the transformed value
+	_, err = tmpl.Execute(map[string]string{"user": "john doe"})
+	if err == nil || !strings.Contains(err.Error(), "user") {
+		t.Errorf("Execute() error = %v, want error naming user", err)
+	}
+
+	_, err = tmpl.Execute(map[string]string{"user": "john", "port": "http"})
+	if err == nil || !strings.Contains(err.Error(), "port") {
+		t.Errorf("Execute() error = %v, want error naming port", err)
+	}
+
+	// partial application keeps invalid values unresolved instead of panicking
+	partial := tmpl.PartialApply(map[string]string{"user": "john", "port": "http"})
+	if got := partial.String(); got != "user=john port=${port?:80}" {
+		t.Errorf("PartialApply() = %q", got)
+	}
+	partial = Compile("${n:clamp:1:9} ${tags:idx:3}").PartialApply(map[string]string{"n": "x", "tags": "a,b"})
+	if got := partial.String(); got != "${n:clamp:1:9} ${tags:idx:3}" {
+		t.Errorf("PartialApply() = %q", got)
+	}
+}
+
+func TestCollapseEmptyGaps(t *testing.T) {
+	tests := []struct {
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{template: "a ${x?:} b", want: "a b"},
+		{template: "${x?:} b", want: "b"},
+		{template: "a ${x?:}", want: "a"},
+		{template: "cmd ${v?:} ${q?:} file", want: "cmd file"},
+		{template: "cmd ${flag} file", vars: map[string]string{"flag": ""}, want: "cmd file"},
+		{template: "cmd ${flag} file", vars: map[string]string{"flag": "-v"}, want: "cmd -v file"},
+		{template: "a${x?:} b", want: "a b"},
+		{template: "a  ${x?:}  b", want: "a   b"},
+		{template: "a ${x?:} ${y?:}", want: "a"},
+		{template: "${x?:} ${y?:} b", want: "b"},
+		{template: "a ${x?:}\nb", want: "a\nb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			got, err := Compile(tt.template).apply(tt.vars, &ApplyOptions{ApplyDefault: true, CollapseEmptyGaps: true})
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("apply() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+
+	// off by default
+	if got, _ := Compile("a ${x?:} b").Execute(nil); got != "a  b" {
+		t.Errorf("Execute() = %q, want %q", got, "a  b")
+	}
+}
+
+func TestDoubleDollarEscape(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantVars []string
+	}{
+		{name: "brace", template: "echo $${x}", vars: map[string]string{"x": "v"}, want: "echo ${x}", wantVars: []string{}},
+		{name: "dollar", template: "echo $$name", vars: map[string]string{"name": "v"}, want: "echo $name", wantVars: []string{}},
+		{name: "paren", template: "$$(name)", vars: map[string]string{"name": "v"}, want: "$(name)", wantVars: []string{}},
+		{name: "literal then variable", template: "$$$name", vars: map[string]string{"name": "v"}, want: "$v", wantVars: []string{"name"}},
+		{name: "pairs before brace", template: "$$$${x}", vars: map[string]string{"x": "v"}, want: "$${x}", wantVars: []string{}},
+		{name: "pairs before variable", template: "$$$$${x}", vars: map[string]string{"x": "v"}, want: "$$v", wantVars: []string{"x"}},
+		{name: "mixed", template: "$${HOME}/$dir \\$x ${y}", vars: map[string]string{"dir": "d", "y": "z"}, want: "${HOME}/d $x z", wantVars: []string{"dir", "y"}},
+		{name: "shell pid stays", template: "echo $$ $$.", vars: map[string]string{}, want: "echo $$ $$.", wantVars: []string{}},
+		{name: "backslash and double dollar", template: "\\$$name", vars: map[string]string{"name": "v"}, want: "$v", wantVars: []string{"name"}},
+		{name: "backslash before brace", template: "\\$${x}", vars: map[string]string{"x": "V"}, want: "$V", wantVars: []string{"x"}},
+		{name: "pair before variable", template: "$$${x}", vars: map[string]string{"x": "V"}, want: "$V", wantVars: []string{"x"}},
+		{name: "unclosed kept", template: "$${a!", vars: map[string]string{}, want: "$${a!", wantVars: []string{}},
+		{name: "empty kept", template: "$${}", vars: map[string]string{}, want: "$${}", wantVars: []string{}},
+		{name: "escaped default", template: "$${a?:${b}}", vars: map[string]string{"b": "v"}, want: "${a?:${b}}", wantVars: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			if got := tmpl.Variables(); !stringSliceEqual(got, tt.wantVars) {
+				t.Errorf("Variables() = %v, want %v", got, tt.wantVars)
+			}
+			got, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveMacros(t *testing.T) {
+	tmpl := Compile(`{"name": "${name?:x}", "ts": "${@timestamp}", "u": "${@unknown}"}`)
+	resolved := tmpl.ResolveMacros()
+	if got := resolved.Variables(); !stringSliceEqual(got, []string{"@unknown", "name"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+	if strings.Contains(resolved.String(), "@timestamp") || !strings.Contains(resolved.String(), "${name?:x}") {
+		t.Errorf("ResolveMacros() = %q", resolved.String())
+	}
+	got, err := resolved.Execute(map[string]string{"name": "john"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if !strings.HasPrefix(got, `{"name": "john", "ts": "`) {
+		t.Errorf("Execute() = %q", got)
+	}
+}
+
+func TestIndexDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		sep      string
+		want     string
+		wantErr  bool
+	}{
+		{name: "first", template: "${tags:idx:0}", vars: map[string]string{"tags": "a,b,c"}, want: "a"},
+		{name: "last", template: "${tags:idx:-1}", vars: map[string]string{"tags": "a,b,c"}, want: "c"},
+		{name: "separator option", template: "${tags:idx:1}", vars: map[string]string{"tags": "a b c"}, sep: " ", want: "b"},
+		{name: "default", template: "${tags?:x,y:idx:1}", vars: map[string]string{}, want: "y"},
+		{name: "out of range", template: "${tags:idx:3}", vars: map[string]string{"tags": "a,b,c"}, wantErr: true},
+		{name: "negative out of range", template: "${tags:idx:-4}", vars: map[string]string{"tags": "a,b,c"}, wantErr: true},
+		{name: "empty list", template: "${tags:idx:0}", vars: map[string]string{"tags": ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).apply(tt.vars, &ApplyOptions{ApplyDefault: true, ListSeparator: tt.sep})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("apply() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+	if _, err := CompileStrict("${tags:idx:first}"); err == nil {
+		t.Error("CompileStrict() should reject a non-numeric index")
+	}
+}
+
+func TestCompileDisableMacros(t *testing.T) {
+	opts := &CompileOptions{DisableMacros: true}
+	for _, tpl := range []string{"at ${@timestamp}", "at $@timestamp"} {
+		tmpl, err := CompileWithOptions(tpl, opts)
+		if err != nil {
+			t.Fatalf("CompileWithOptions(%q) error = %v", tpl, err)
+		}
+		if tmpl.HasVariables() {
+			t.Errorf("CompileWithOptions(%q) should have no variables, got %v", tpl, tmpl.Variables())
+		}
+		if got, _ := tmpl.Execute(nil); got != tpl {
+			t.Errorf("Execute() = %q, want %q", got, tpl)
+		}
+	}
+	if _, err := CompileWithOptions("${@timestamp}", &CompileOptions{Strict: true, DisableMacros: true}); err == nil {
+		t.Error("strict compile should reject @timestamp when macros are disabled")
+	}
+
+	tmpl, _ := CompileWithOptions("${name}", opts)
+	tmpl.Reset("${@timestamp} ${name}")
+	if got, _ := tmpl.Execute(map[string]string{"name": "x"}); got != "${@timestamp} x" {
+		t.Errorf("Reset() should keep DisableMacros, got %q", got)
+	}
+}
+
+func TestExecuteWithStats(t *testing.T) {
+	tmpl := Compile("Hello ${name}, ${greeting?:hi} ${missing}")
+	got, stats, err := tmpl.ExecuteWithStats(map[string]string{"name": "Alexander"})
+	if err != nil {
+		t.Fatalf("ExecuteWithStats() error = %v", err)
+	}
+	if got != "Hello Alexander, hi ${missing}" {
+		t.Errorf("ExecuteWithStats() = %q", got)
+	}
+	want := RenderStats{
+		SubstitutionCount: 2,
+		OutputBytes:       len(got),
+		DeltaBytes:        len(got) - len(tmpl.Template()),
+	}
+	if stats != want {
+		t.Errorf("ExecuteWithStats() stats = %+v, want %+v", stats, want)
+	}
+	if stats.DeltaBytes != -11 {
+		t.Errorf("DeltaBytes = %d, want -11", stats.DeltaBytes)
+	}
+
+	if _, _, err := Compile("${id!}").ExecuteWithStats(nil); err == nil {
+		t.Error("ExecuteWithStats() should fail on a missing required variable")
+	}
+}
+
+func TestDefaultExpression(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{name: "multiply", template: `{"timeout": "${timeout?:${base}*2:%d}"}`, vars: map[string]string{"base": "15"}, want: `{"timeout": 30}`},
+		{name: "add", template: "${port?:$base+1}", vars: map[string]string{"base": "8080"}, want: "8081"},
+		{name: "literal first", template: "${n?:3 * ${base}}", vars: map[string]string{"base": "4"}, want: "12"},
+		{name: "reference", template: "${host?:${default_host}}", vars: map[string]string{"default_host": "localhost"}, want: "localhost"},
+		{name: "explicit value wins", template: "${timeout?:${base}*2}", vars: map[string]string{"timeout": "5", "base": "15"}, want: "5"},
+		{name: "missing reference", template: "a ${timeout?:${base}*2}", vars: map[string]string{}, want: "a ${timeout?:${base}*2}"},
+		{name: "literal default", template: "${x?:2*3}", vars: map[string]string{}, want: "2*3"},
+		{name: "not a number", template: "${timeout?:${base}*2}", vars: map[string]string{"base": "abc"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).Execute(tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// the value of a failing operand, possibly secret, is not in the error
+	_, err := Compile("${pw:secret} ${n?:${pw}*2:%d}").Execute(map[string]string{"pw": "hunter2"})
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Execute() error = %v, want an error without the value", err)
+	}
+
+	// operands are used variables
+	_, used, err := Compile("${t?:${b}*2}").ExecuteWithUsed(map[string]string{"b": "3"})
+	if err != nil || !stringSliceEqual(used, []string{"b"}) {
+		t.Errorf("ExecuteWithUsed() used = %v, %v, want [b]", used, err)
+	}
+}
+
+func TestVarRawContent(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "${name}", want: "name"},
+		{template: "${ name?:x y :%d }", want: " name?:x y :%d "},
+		{template: "$name.txt", want: "name"},
+		{template: "$(name)s", want: "name"},
+		{template: "${t?:${base}*2}", want: "t?:${base}*2"},
+	}
+	for _, tt := range tests {
+		tmpl := Compile(tt.template)
+		if tmpl.NumVars() != 1 {
+			t.Fatalf("Compile(%q) NumVars() = %d, want 1", tt.template, tmpl.NumVars())
+		}
+		if got := tmpl.Var(0).RawContent(); got != tt.want {
+			t.Errorf("Compile(%q) RawContent() = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestSubtemplate(t *testing.T) {
+	tmpl := Compile("Hello ${name}, you are $age years old")
+
+	sub, err := tmpl.Subtemplate(6, 14)
+	if err != nil {
+		t.Fatalf("Subtemplate() error = %v", err)
+	}
+	if sub.Template() != "${name}," {
+		t.Errorf("Subtemplate() template = %q", sub.Template())
+	}
+	if !stringSliceEqual(sub.Variables(), []string{"name"}) {
+		t.Errorf("Subtemplate() variables = %v", sub.Variables())
+	}
+	if got, _ := sub.Execute(map[string]string{"name": "Bob", "age": "3"}); got != "Bob," {
+		t.Errorf("Execute() = %q", got)
+	}
+
+	sub, err = tmpl.Subtemplate(15, len(tmpl.Template()))
+	if err != nil {
+		t.Fatalf("Subtemplate() error = %v", err)
+	}
+	if got, _ := sub.Execute(map[string]string{"age": "3"}); got != "you are 3 years old" {
+		t.Errorf("Execute() = %q", got)
+	}
+
+	for _, r := range [][2]int{{8, 20}, {0, 24}, {-1, 3}, {5, 100}, {4, 3}} {
+		if _, err := tmpl.Subtemplate(r[0], r[1]); err == nil {
+			t.Errorf("Subtemplate(%d, %d) should fail", r[0], r[1])
+		}
+	}
+
+	src := "${a?:${b}}"
+	sub, err = Compile(src).Subtemplate(0, len(src))
+	if err != nil {
+		t.Fatalf("Subtemplate() error = %v", err)
+	}
+	if got := sub.Variables(); !stringSliceEqual(got, []string{"a", "b"}) {
+		t.Errorf("Variables() = %v, want [a b]", got)
+	}
+}
+
+func TestRepeatModeWordForms(t *testing.T) {
+	tests := []struct {
+		symbol string
+		word   string
+		want   repeatMode
+	}{
+		{symbol: "${a:+}", word: "${a:uniq}", want: repeatMode_Uniq},
+		{symbol: "${a:*}", word: "${a:any}", want: repeatMode_Any},
+		{symbol: "${a?:x,x:+}", word: "${a?:x,x:uniq}", want: repeatMode_Uniq},
+	}
+	for _, tt := range tests {
+		symbol, err := CompileStrict(tt.symbol)
+		if err != nil {
+			t.Fatalf("CompileStrict(%q) error = %v", tt.symbol, err)
+		}
+		word, err := CompileStrict(tt.word)
+		if err != nil {
+			t.Fatalf("CompileStrict(%q) error = %v", tt.word, err)
+		}
+		if symbol.varPositions[0].repeatMode != tt.want || word.varPositions[0].repeatMode != tt.want {
+			t.Errorf("%q and %q should both have repeat mode %d", tt.symbol, tt.word, tt.want)
+		}
+		vars := map[string]string{"a": "x,y,x"}
+		got1, _ := symbol.Execute(vars)
+		got2, _ := word.Execute(vars)
+		if got1 != got2 {
+			t.Errorf("Execute() %q = %q, %q = %q", tt.symbol, got1, tt.word, got2)
+		}
+	}
+}
+
+func TestBashRunner(t *testing.T) {
+	var ran []string
+	opts := &ApplyOptions{
+		BashRunner: func(ctx context.Context, cmd string) (string, error) {
+			ran = append(ran, cmd)
+			if cmd == "fail" {
+				return "", errors.New("not allowed")
+			}
+			return "{\n  \"ok\": true\n}\n", nil
+		},
+	}
+	got, err := Compile("out: ${echo hi:bash}").apply(nil, opts)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got.String() != "out: {\n  \"ok\": true\n}\n" {
+		t.Errorf("apply() = %q", got.String())
+	}
+	if !stringSliceEqual(ran, []string{"echo hi"}) {
+		t.Errorf("BashRunner called with %v", ran)
+	}
+	if _, err := Compile("${fail:bash}").apply(nil, opts); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("apply() error = %v, want runner error", err)
+	}
+}
+
+func TestFileFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"config/banner.txt": &fstest.MapFile{Data: []byte("welcome")},
+	}
+	got, err := Compile("${config/banner.txt:file}!").apply(nil, &ApplyOptions{FS: fsys})
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got.String() != "welcome!" {
+		t.Errorf("apply() = %q, want %q", got.String(), "welcome!")
+	}
+	if _, err := Compile("${missing.txt:file}").apply(nil, &ApplyOptions{FS: fsys}); err == nil {
+		t.Error("apply() should fail for a file missing from FS")
+	}
+}
+
+func TestMergeVars(t *testing.T) {
+	base := map[string]string{"host": "localhost", "port": "80"}
+	override := map[string]string{"port": "8080"}
+	got := MergeVars(base, nil, override)
+	want := map[string]string{"host": "localhost", "port": "8080"}
+	if len(got) != len(want) || got["host"] != want["host"] || got["port"] != want["port"] {
+		t.Errorf("MergeVars() = %v, want %v", got, want)
+	}
+	if base["port"] != "80" || len(override) != 1 {
+		t.Error("MergeVars() should not modify its inputs")
+	}
+	got["extra"] = "x"
+	if _, ok := base["extra"]; ok {
+		t.Error("MergeVars() should return a new map")
+	}
+	if got := MergeVars(); got == nil || len(got) != 0 {
+		t.Errorf("MergeVars() = %v, want empty map", got)
+	}
+}
+
+func TestApplyDefaultsMap(t *testing.T) {
+	defaults := map[string]string{"host": "localhost", "token": "dev-token"}
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		override bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "from defaults", template: "${host}", vars: nil, want: "localhost"},
+		{name: "vars win", template: "${host}", vars: map[string]string{"host": "example.com"}, want: "example.com"},
+		{name: "defaults map before inline default", template: "${host?:inline}", vars: nil, want: "localhost"},
+		{name: "inline default when not in map", template: "${port?:80}", vars: nil, want: "80"},
+		{name: "required from defaults", template: "${token!}", vars: nil, want: "dev-token"},
+		{name: "required from defaults with override", template: "${token!}", vars: nil, override: true, wantErr: true},
+		{name: "required from inline default with override", template: "${port!?:80}", vars: nil, override: true, wantErr: true},
+		{name: "required explicit with override", template: "${token!}", vars: map[string]string{"token": "t"}, override: true, want: "t"},
+		{name: "optional from defaults with override", template: "${host}", vars: nil, override: true, want: "localhost"},
+		{name: "required missing", template: "${secret!}", vars: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).apply(tt.vars, &ApplyOptions{
+				ApplyDefault:              true,
+				ValidateRequired:          true,
+				Defaults:                  defaults,
+				RequiredOverridesDefaults: tt.override,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("apply() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNumMacros(t *testing.T) {
+	tmpl := Compile("${@timestamp} ${name} ${@timestamp_ms} $@timestamp")
+	if got := tmpl.NumMacros(); got != 3 {
+		t.Errorf("NumMacros() = %d, want 3", got)
+	}
+	got := tmpl.MacroOccurrences()
+	if len(got) != 2 || got["@timestamp"] != 2 || got["@timestamp_ms"] != 1 {
+		t.Errorf("MacroOccurrences() = %v", got)
+	}
+	static := Compile("Hello ${name}")
+	if static.NumMacros() != 0 || len(static.MacroOccurrences()) != 0 {
+		t.Error("template without macros should report none")
+	}
+}
+
+func TestAllowDotInDollarName(t *testing.T) {
+	vars := map[string]string{"config.db.host": "db.local", "name": "Bob", "config": "C"}
+	tests := []struct {
+		template string
+		allowDot bool
+		want     string
+	}{
+		{template: "host=$config.db.host", allowDot: true, want: "host=db.local"},
+		{template: "host=$config.db.host", allowDot: false, want: "host=C.db.host"},
+		{template: "Hello $name.", allowDot: true, want: "Hello Bob."},
+		{template: "Hello $name..", allowDot: true, want: "Hello Bob.."},
+		{template: "$(config.db.host)!", allowDot: true, want: "db.local!"},
+	}
+	for _, tt := range tests {
+		tmpl, err := CompileWithOptions(tt.template, &CompileOptions{AllowDotInDollarName: tt.allowDot})
+		if err != nil {
+			t.Fatalf("CompileWithOptions(%q) error = %v", tt.template, err)
+		}
+		if got, _ := tmpl.Execute(vars); got != tt.want {
+			t.Errorf("Execute(%q, allowDot=%v) = %q, want %q", tt.template, tt.allowDot, got, tt.want)
+		}
+	}
+}
+
+func TestCompileWarnings(t *testing.T) {
+	tmpl := Compile("a ${} b ${name:a:b} c ${name} d ${open")
+	got := tmpl.CompileWarnings()
+	if len(got) != 3 {
+		t.Fatalf("CompileWarnings() = %v, want 3 warnings", got)
+	}
+	wantOffsets := []int{2, 8, 32}
+	for i, w := range got {
+		if w.Offset != wantOffsets[i] {
+			t.Errorf("warning %d offset = %d, want %d", i, w.Offset, wantOffsets[i])
+		}
+	}
+	if !strings.Contains(got[0].Reason, "empty variable name") {
+		t.Errorf("warning 0 = %v", got[0])
+	}
+	if got[2].String() != "offset 32: unclosed variable" {
+		t.Errorf("warning 2 = %v", got[2])
+	}
+
+	tmpl.Reset("${name}")
+	if len(tmpl.CompileWarnings()) != 0 {
+		t.Errorf("Reset() should clear warnings, got %v", tmpl.CompileWarnings())
+	}
+}
+
+func TestRenderedLen(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+	}{
+		{name: "static", template: "static text"},
+		{name: "empty", template: ""},
+		{name: "plain", template: "Hello ${name}, $name!", vars: map[string]string{"name": "World"}},
+		{name: "number unquoted", template: `{"age": "${age:%d}", "n": "${n?:12:%d}"}`, vars: map[string]string{"age": "25"}},
+		{name: "transforms", template: "${a:shell_quote} ${b:html} ${c:urlencode} ${d:join:,:, }", vars: map[string]string{"a": "x y", "b": "<b>", "c": "a b&c", "d": "1,2,3"}},
+		{name: "missing kept", template: "${a} ${b}", vars: map[string]string{"a": "1"}},
+		{name: "multibyte", template: "${x}é", vars: map[string]string{"x": "日本"}},
+		{name: "conditional", template: "host${?port:::}", vars: map[string]string{"port": "80"}},
+		{name: "escapes", template: `$$a \${b} ${c}`, vars: map[string]string{"c": "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			want, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tmpl.RenderedLen(tt.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != len(want) {
+				t.Errorf("RenderedLen() = %d, want %d (%q)", got, len(want), want)
+			}
+		})
+	}
+
+	if _, err := Compile("${a!}").RenderedLen(nil); err == nil {
+		t.Error("expected missing required error")
+	}
+	if _, err := Compile("${a}").WithRequiredGroup("a", "b").RenderedLen(nil); err == nil {
+		t.Error("expected required group error")
+	}
+	if n, err := Compile("${a}").Bind("a", "xyz").RenderedLen(nil); err != nil || n != 3 {
+		t.Errorf("RenderedLen() with binding = %d, %v", n, err)
+	}
+}
+
+func TestBindSpec(t *testing.T) {
+	type dbConfig struct {
+		Host    string `vartmpl:"host,required"`
+		Port    int    `vartmpl:"port,default=5432"`
+		User    string `vartmpl:",default=postgres"`
+		Comment string
+		Skipped string `vartmpl:"-"`
+	}
+	tmpl := Compile("${host}:${port:%d} ${User} ${@build?:dev}")
+
+	bound, err := tmpl.BindSpec(&dbConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := bound.Execute(map[string]string{"host": "db"})
+	if err != nil || got != "db:5432 postgres dev" {
+		t.Errorf("Execute() = %q, %v", got, err)
+	}
+	if _, err := bound.Execute(nil); err == nil || !strings.Contains(err.Error(), "required variable host") {
+		t.Errorf("expected host to be required, got %v", err)
+	}
+	// the original is untouched
+	if got, _ := tmpl.Execute(nil); !strings.HasPrefix(got, "${host}:") {
+		t.Errorf("original Execute() = %q", got)
+	}
+	if _, err := tmpl.BindSpec(dbConfig{}); err != nil {
+		t.Errorf("BindSpec(struct value) = %v", err)
+	}
+
+	errTests := []struct {
+		name    string
+		tmpl    string
+		spec    interface{}
+		wantErr string
+	}{
+		{name: "undeclared", tmpl: "${host} ${b} ${a} ${b}", spec: dbConfig{}, wantErr: "undeclared variables: a, b"},
+		{name: "skipped field", tmpl: "${Skipped}", spec: dbConfig{}, wantErr: "undeclared variables: Skipped"},
+		{name: "untagged field", tmpl: "${Comment}", spec: dbConfig{}, wantErr: "undeclared variables: Comment"},
+		{name: "not a struct", tmpl: "${a}", spec: map[string]string{}, wantErr: "spec must be a struct"},
+		{name: "nil", tmpl: "${a}", spec: nil, wantErr: "spec must be a struct"},
+		{name: "unknown option", tmpl: "${a}", spec: struct {
+			A string `vartmpl:"a,optional"`
+		}{}, wantErr: `unknown vartmpl option "optional"`},
+		{name: "duplicate", tmpl: "${a}", spec: struct {
+			A string `vartmpl:"a"`
+			B string `vartmpl:"a"`
+		}{}, wantErr: "variable a declared twice"},
+	}
+	// a declared default replaces a computed one and what it referenced
+	computed, err := Compile("${port?:${base}+1}").BindSpec(struct {
+		Port int `vartmpl:"port,default=5432"`
+	}{})
+	if err != nil || !stringSliceEqual(computed.Variables(), []string{"port"}) {
+		t.Errorf("BindSpec() Variables() = %v, %v, want [port]", computed.Variables(), err)
+	}
+
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.tmpl).BindSpec(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("BindSpec() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecuteOrDefault(t *testing.T) {
+	tmpl := Compile("Hello ${name!}")
+	if got := tmpl.ExecuteOrDefault(map[string]string{"name": "World"}, "Hello"); got != "Hello World" {
+		t.Errorf("ExecuteOrDefault() = %q, want rendered output", got)
+	}
+	if got := tmpl.ExecuteOrDefault(nil, "Hello"); got != "Hello" {
+		t.Errorf("ExecuteOrDefault() = %q, want fallback", got)
+	}
+	// a successful empty render is not replaced
+	if got := Compile("${x?:}").ExecuteOrDefault(nil, "fallback"); got != "" {
+		t.Errorf("ExecuteOrDefault() = %q, want empty", got)
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		format   string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default keeps value", template: `{"age": "${age:%d}"}`, vars: map[string]string{"age": "007"}, want: `{"age": 007}`},
+		{name: "zero padded", template: `{"age": "${age:%d}"}`, vars: map[string]string{"age": "7"}, format: "%05d", want: `{"age": 00007}`},
+		{name: "all number variables", template: "${a:%d}-${b:%d}-${c}", vars: map[string]string{"a": "1", "b": "22", "c": "3"}, format: "%03d", want: "001-022-3"},
+		{name: "normalizes", template: "${a:%d}", vars: map[string]string{"a": "007"}, format: "%d", want: "7"},
+		{name: "hex", template: "${a:%d}", vars: map[string]string{"a": "255"}, format: "%x", want: "ff"},
+		{name: "after clamp", template: "${w:clamp:1:64}", vars: map[string]string{"w": "100"}, format: "%04d", want: "0064"},
+		{name: "default value", template: "${n?:5:%d}", vars: map[string]string{}, format: "%02d", want: "05"},
+		{name: "not a number", template: "${a:%d}", vars: map[string]string{"a": "x"}, format: "%05d", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).ExecuteWithOptions(tt.vars, &ApplyOptions{
+				ApplyDefault:     true,
+				ValidateRequired: true,
+				NumberFormat:     tt.format,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithAlias(t *testing.T) {
+	tmpl := Compile("${user_name?:anon} ${host}").WithAlias("user_name", "username").WithAlias("host", "hostname")
+	tests := []struct {
+		name string
+		vars map[string]string
+		want string
+	}{
+		{name: "alias hit", vars: map[string]string{"username": "alice", "hostname": "db"}, want: "alice db"},
+		{name: "direct value wins", vars: map[string]string{"user_name": "bob", "username": "alice", "host": "h", "hostname": "db"}, want: "bob h"},
+		{name: "miss falls back to default", vars: map[string]string{"hostname": "db"}, want: "anon db"},
+		{name: "miss keeps variable", vars: map[string]string{}, want: "anon ${host}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// one level only, no cycles
+	chained := Compile("${a}").WithAlias("a", "b").WithAlias("b", "c")
+	if got, _ := chained.Execute(map[string]string{"c": "x"}); got != "${a}" {
+		t.Errorf("chained alias = %q, want unresolved", got)
+	}
+	cyclic := Compile("${a}").WithAlias("a", "b").WithAlias("b", "a")
+	if got, _ := cyclic.Execute(map[string]string{"b": "x"}); got != "x" {
+		t.Errorf("cyclic alias = %q, want x", got)
+	}
+
+	// the canonical name is not an unknown variable
+	_, err := tmpl.ExecuteWithOptions(map[string]string{"username": "a", "host": "h"}, &ApplyOptions{DisallowExtraVars: true})
+	if err != nil {
+		t.Errorf("DisallowExtraVars: %v", err)
+	}
+	if tmpl.Fingerprint() == Compile("${user_name?:anon} ${host}").Fingerprint() {
+		t.Error("aliases should change the fingerprint")
+	}
+
+	// used names are canonical, computed defaults resolve aliases too
+	_, used, err := Compile("${old}").WithAlias("old", "new").ExecuteWithUsed(map[string]string{"new": "v"})
+	if err != nil || !stringSliceEqual(used, []string{"new"}) {
+		t.Errorf("ExecuteWithUsed() used = %v, %v, want [new]", used, err)
+	}
+	defaults := Compile("${x?:${old}} ${y?:${old}*2} ${z?:<${old}>}").WithAlias("old", "new")
+	if got, _ := defaults.Execute(map[string]string{"new": "3"}); got != "3 6 <3>" {
+		t.Errorf("Execute() = %q, want %q", got, "3 6 <3>")
+	}
+
+	// gates resolve aliases too
+	gated := Compile("${p:shell_quote_if:q}").WithAlias("q", "quote")
+	if got, _ := gated.Execute(map[string]string{"p": "a b", "quote": "1"}); got != "'a b'" {
+		t.Errorf("Execute() = %q, want %q", got, "'a b'")
+	}
+}
+
+func TestEmptyNumberValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		zero     bool
+		want     string
+	}{
+		{name: "default", template: `{"count": "${count?:10:%d}"}`, vars: map[string]string{"count": ""}, want: `{"count": 10}`},
+		{name: "default wins over zero", template: `{"count": "${count?:10:%d}"}`, vars: map[string]string{"count": ""}, zero: true, want: `{"count": 10}`},
+		{name: "zero", template: `{"count": "${count:%d}"}`, vars: map[string]string{"count": ""}, zero: true, want: `{"count": 0}`},
+		{name: "empty kept", template: `{"count": "${count:%d}"}`, vars: map[string]string{"count": ""}, want: `{"count": }`},
+		{name: "value", template: `{"count": "${count?:10:%d}"}`, vars: map[string]string{"count": "3"}, zero: true, want: `{"count": 3}`},
+		{name: "plain vars unaffected", template: `${s?:x}`, vars: map[string]string{"s": ""}, zero: true, want: ``},
+		{name: "clamped zero", template: `${n:clamp:1:5}`, vars: map[string]string{"n": ""}, zero: true, want: `1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).ExecuteWithOptions(tt.vars, &ApplyOptions{
+				ApplyDefault:      true,
+				ValidateRequired:  true,
+				EmptyNumberAsZero: tt.zero,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludeDirective(t *testing.T) {
+	fsys := fstest.MapFS{
+		"header.tmpl": {Data: []byte("# ${title!}")},
+		"footer.tmpl": {Data: []byte("-- ${author?:anon} ${@unknown}")},
+		"nested.tmpl": {Data: []byte("[${header.tmpl:include}]")},
+		"self.tmpl":   {Data: []byte("${self.tmpl:include}")},
+		"todo.tmpl":   {Data: []byte("${a} and ${b}")},
+		"a.tmpl":      {Data: []byte("[${a}]")},
+	}
+	opts := &ApplyOptions{ApplyDefault: true, ApplyMacro: true, ValidateRequired: true, FS: fsys}
+
+	tmpl := Compile("${header.tmpl:include}\nbody\n${footer.tmpl:include}")
+	got, err := tmpl.ExecuteWithOptions(map[string]string{"title": "Hi"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "# Hi\nbody\n-- anon ${@unknown}" {
+		t.Errorf("Execute() = %q", got)
+	}
+	if kind := tmpl.Var(0).Kind(); kind != KindInclude {
+		t.Errorf("Kind() = %v, want include", kind)
+	}
+
+	got, err = Compile("${nested.tmpl:include}").ExecuteWithOptions(map[string]string{"title": "Hi"}, opts)
+	if err != nil || got != "[# Hi]" {
+		t.Errorf("nested include = %q, %v", got, err)
+	}
+
+	if _, err := tmpl.ExecuteWithOptions(nil, opts); err == nil || !strings.Contains(err.Error(), "include header.tmpl: required variable title! is missing") {
+		t.Errorf("expected missing title error, got %v", err)
+	}
+	if _, err := Compile("${self.tmpl:include}").ExecuteWithOptions(nil, opts); err == nil || !strings.Contains(err.Error(), "nested more than") {
+		t.Errorf("expected depth error, got %v", err)
+	}
+	if _, err := Compile("${none.tmpl:include}").ExecuteWithOptions(nil, opts); err == nil || !strings.Contains(err.Error(), "failed to read include none.tmpl") {
+		t.Errorf("expected read error, got %v", err)
+	}
+
+	// variables left in the included text surface in the result
+	partial := Compile("<${todo.tmpl:include}> ${c}").Apply(map[string]string{"a": "1"}, &ApplyOptions{FS: fsys})
+	if partial.String() != "<1 and ${b}> ${c}" {
+		t.Errorf("Apply() = %q", partial.String())
+	}
+	if vars := partial.Variables(); len(vars) != 2 || vars[0] != "b" || vars[1] != "c" {
+		t.Errorf("Variables() = %v, want [b c]", vars)
+	}
+	got, err = partial.Execute(map[string]string{"b": "2", "c": "3"})
+	if err != nil || got != "<1 and 2> 3" {
+		t.Errorf("Execute() = %q, %v", got, err)
+	}
+
+	// variables used only by an included template are not extra
+	strict := &ApplyOptions{ApplyDefault: true, DisallowExtraVars: true, FS: fsys}
+	got, err = Compile("${nested.tmpl:include}").ExecuteWithOptions(map[string]string{"title": "Hi"}, strict)
+	if err != nil || got != "[# Hi]" {
+		t.Errorf("Execute() = %q, %v", got, err)
+	}
+	if _, err := Compile("${header.tmpl:include}").ExecuteWithOptions(map[string]string{"title": "Hi", "x": "1"}, strict); err == nil || err.Error() != "unknown variables: x" {
+		t.Errorf("expected unknown variables: x, got %v", err)
+	}
+
+	// validators and aliases of the including template apply to the included one
+	validated := Compile("${a.tmpl:include}").WithValidators(map[string]func(string) error{
+		"a": func(v string) error { return errors.New("bad") },
+	})
+	if _, err := validated.ExecuteWithOptions(map[string]string{"a": "x"}, opts); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("expected validator error, got %v", err)
+	}
+	aliased := Compile("${a.tmpl:include}").WithAlias("a", "b")
+	got, err = aliased.ExecuteWithOptions(map[string]string{"b": "x"}, strict)
+	if err != nil || got != "[x]" {
+		t.Errorf("aliased include = %q, %v", got, err)
+	}
+
+	// includes are recorded in VisitedFiles
+	visited := map[string]bool{"self.tmpl": true}
+	if _, err := Compile("${self.tmpl:include}").ExecuteWithOptions(nil, &ApplyOptions{FS: fsys, VisitedFiles: visited}); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected self-reference error, got %v", err)
+	}
+}
+
+func TestVarErrors(t *testing.T) {
+	tmpl := Compile("a ${} b ${ name:a:b } c ${name} d ${v:clamp:9:1} ${open")
+	got := tmpl.VarErrors()
+	want := map[string]string{
+		"${}":            "empty variable name",
+		"${ name:a:b }":  "multiple directives",
+		"${v:clamp:9:1}": "greater than max",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("VarErrors() = %v, want %d entries", got, len(want))
+	}
+	for raw, reason := range want {
+		if err := got[raw]; err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("VarErrors()[%q] = %v, want %q", raw, err, reason)
+		}
+	}
+
+	if errs := Compile("${name} $age").VarErrors(); errs != nil {
+		t.Errorf("VarErrors() = %v, want nil", errs)
+	}
+	tmpl.Reset("${name}")
+	if errs := tmpl.VarErrors(); errs != nil {
+		t.Errorf("Reset() should clear var errors, got %v", errs)
+	}
+}
+
+func TestAllowHyphenInName(t *testing.T) {
+	vars := map[string]string{"name-suffix": "joined", "name": "N", "other": "O"}
+	tests := []struct {
+		template    string
+		allowHyphen bool
+		want        string
+	}{
+		{template: "$name-suffix", allowHyphen: true, want: "joined"},
+		{template: "${name-suffix}", allowHyphen: true, want: "joined"},
+		{template: "$other-file", allowHyphen: false, want: "O-file"},
+		{template: "$name-suffix", allowHyphen: false, want: "N-suffix"},
+		{template: "$name- x", allowHyphen: true, want: "N- x"},
+		{template: "${name-suffix!}", allowHyphen: true, want: "joined"},
+	}
+	for _, tt := range tests {
+		tmpl, err := CompileWithOptions(tt.template, &CompileOptions{AllowHyphenInName: tt.allowHyphen})
+		if err != nil {
+			t.Fatalf("CompileWithOptions(%q) error = %v", tt.template, err)
+		}
+		if got, _ := tmpl.Execute(vars); got != tt.want {
+			t.Errorf("Execute(%q, allowHyphen=%v) = %q, want %q", tt.template, tt.allowHyphen, got, tt.want)
+		}
+	}
+}
+
+func TestRequireBoundaryBeforeDollar(t *testing.T) {
+	vars := map[string]string{"name": "N", "b": "B"}
+	tests := []struct {
+		template string
+		boundary bool
+		want     string
+	}{
+		{template: "a$name", boundary: false, want: "aN"},
+		{template: "a$name", boundary: true, want: "a$name"},
+		{template: " $name", boundary: true, want: " N"},
+		{template: "$name", boundary: true, want: "N"},
+		{template: "(a,$name)", boundary: true, want: "(a,N)"},
+		{template: "é$name", boundary: true, want: "é$name"},
+		{template: "_$name", boundary: true, want: "_$name"},
+		{template: "$name$b", boundary: true, want: "N$b"},
+		{template: "${b}$name", boundary: true, want: "BN"},
+		{template: "x${b}y$name", boundary: true, want: "xBy$name"},
+		{template: "a${name}", boundary: true, want: "aN"},
+		{template: "a$(name)", boundary: true, want: "aN"},
+		{template: "it costs 5$name", boundary: true, want: "it costs 5$name"},
+	}
+	for _, tt := range tests {
+		tmpl, err := CompileWithOptions(tt.template, &CompileOptions{RequireBoundaryBeforeDollar: tt.boundary})
+		if err != nil {
+			t.Fatalf("CompileWithOptions(%q) error = %v", tt.template, err)
+		}
+		if got, _ := tmpl.Execute(vars); got != tt.want {
+			t.Errorf("Execute(%q, boundary=%v) = %q, want %q", tt.template, tt.boundary, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{name: "slugify", template: "${title:replace: :_}", vars: map[string]string{"title": "hello big world"}, want: "hello_big_world"},
+		{name: "escaped colon", template: `${addr:replace:\::-}`, vars: map[string]string{"addr": "a:b:c"}, want: "a-b-c"},
+		{name: "delete", template: "${v:replace:-:}", vars: map[string]string{"v": "1-2-3"}, want: "123"},
+		{name: "space as TO", template: "${s:replace:-: }", vars: map[string]string{"s": "a-b-c"}, want: "a b c"},
+		{name: "empty from is a no-op", template: "${v:replace::x}", vars: map[string]string{"v": "abc"}, want: "abc"},
+		{name: "default", template: "${v?:a b:replace: :+}", vars: map[string]string{}, want: "a+b"},
+		{name: "missing TO", template: "${v:replace:a}", wantErr: true},
+		{name: "too many args", template: "${v:replace:a:b:c}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := CompileStrict(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileStrict() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, _ := tmpl.Execute(tt.vars); got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantErr  string
+	}{
+		{name: "all provided", template: "${a} ${b!}", vars: map[string]string{"a": "1", "b": "2"}, want: "1 2"},
+		{name: "plain missing", template: "${a} ${b!}", vars: map[string]string{"b": "2"}, wantErr: "required variable a is missing"},
+		{name: "dollar missing", template: "x=$a", vars: map[string]string{}, wantErr: "required variable a is missing"},
+		{name: "explicit required missing", template: "${a} ${b!}", vars: map[string]string{"a": "1"}, wantErr: "required variable b! is missing"},
+		{name: "default exempt", template: "${a?:x} ${b}", vars: map[string]string{"b": "2"}, want: "x 2"},
+		{name: "required with default", template: "${a!?:x}", vars: map[string]string{}, want: "x"},
+		{name: "macro exempt", template: "${@unknown}", vars: map[string]string{}, want: "${@unknown}"},
+		{name: "conditional exempt", template: "host${?port:::}", vars: map[string]string{}, want: "host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).ExecuteWithOptions(tt.vars, &ApplyOptions{
+				ApplyDefault:     true,
+				ApplyMacro:       true,
+				ValidateRequired: true,
+				RequireAll:       true,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// without ValidateRequired missing variables are kept
+	got, err := Compile("${a} ${b!}").ExecuteWithOptions(map[string]string{}, &ApplyOptions{RequireAll: true})
+	if err != nil || got != "${a} ${b!}" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	tmpl := Compile("Hello ${name!}, ${age?:3:%d} ${token:secret} ${name}")
+	text, err := tmpl.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `template "Hello ${name!}, ${age?:3:%d} ${***} ${name}"
+  age %d default=3
+  name required
+  *** secret`
+	if string(text) != want {
+		t.Errorf("MarshalText() =\n%s\nwant\n%s", text, want)
+	}
+	if tmpl.String() != "Hello ${name!}, ${age?:3:%d} ${token:secret} ${name}" {
+		t.Errorf("String() = %q, want the plain text", tmpl.String())
+	}
+
+	text, _ = Compile("${token?:hunter2:secret}").MarshalText()
+	if strings.Contains(string(text), "hunter2") || strings.Contains(string(text), "token") {
+		t.Errorf("MarshalText() = %q, secret default not redacted", text)
+	}
+	data, err := json.Marshal(Compile("${a}"))
+	if err != nil || string(data) != `"template \"${a}\"\n  a"` {
+		t.Errorf("json.Marshal() = %s, %v", data, err)
+	}
+
+	text, _ = Compile("plain").MarshalText()
+	if string(text) != `template "plain"` {
+		t.Errorf("MarshalText() = %q", text)
+	}
+}
+
+func TestJoinDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{name: "normalize csv", template: "${tags:join:,:, }", vars: map[string]string{"tags": "a,b,c"}, want: "a, b, c"},
+		{name: "trims items", template: "${tags:join:,:, }", vars: map[string]string{"tags": " a ,b,  c"}, want: "a, b, c"},
+		{name: "trailing and empty items", template: "${tags:join:,:;}", vars: map[string]string{"tags": "a,,b,"}, want: "a;b"},
+		{name: "empty input", template: "[${tags:join:,:;}]", vars: map[string]string{"tags": ""}, want: "[]"},
+		{name: "only separators", template: "[${tags:join:,:;}]", vars: map[string]string{"tags": ",,"}, want: "[]"},
+		{name: "escaped colon", template: `${v:join:\::/}`, vars: map[string]string{"v": "a:b"}, want: "a/b"},
+		{name: "empty WITH", template: "${v:join: :}", vars: map[string]string{"v": "a b c"}, want: "abc"},
+		{name: "default", template: "${v?:x|y:join:|:+}", vars: map[string]string{}, want: "x+y"},
+		{name: "empty SEP", template: "${v:join::,}", wantErr: true},
+		{name: "missing WITH", template: "${v:join:,}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := CompileStrict(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileStrict() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, _ := tmpl.Execute(tt.vars); got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteToFile(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/config.json"
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Compile(`{"id": "${id!}"}`).ExecuteToFile(path, nil, 0600); err == nil {
+		t.Fatal("ExecuteToFile() should fail on a missing required variable")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("failed render should keep the file, got %q", data)
+	}
+
+	if err := Compile(`{"id": "${id!}"}`).ExecuteToFile(path, map[string]string{"id": "42"}, 0600); err != nil {
+		t.Fatalf("ExecuteToFile() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"id": "42"}` {
+		t.Errorf("file content = %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want 0600", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestMacroResolver(t *testing.T) {
+	vault := map[string]string{"DB_PASS": "s3cret"}
+	resolver := func(name string) (func() (string, error), bool) {
+		if !strings.HasPrefix(name, "secret.") {
+			return nil, false
+		}
+		return func() (string, error) {
+			key := strings.TrimPrefix(name, "secret.")
+			if v, ok := vault[key]; ok {
+				return v, nil
+			}
+			return "", fmt.Errorf("no secret %s", key)
+		}, true
+	}
+	opts := &ApplyOptions{ApplyMacro: true, MacroResolver: resolver}
+
+	got, err := Compile("pass=${@secret.DB_PASS} unknown=${@other}").apply(nil, opts)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got.String() != "pass=s3cret unknown=${@other}" {
+		t.Errorf("apply() = %q", got.String())
+	}
+
+	got, err = Compile("${@timestamp}").apply(nil, opts)
+	if err != nil || got.String() == "${@timestamp}" {
+		t.Errorf("builtins should still resolve, got %q, %v", got, err)
+	}
+
+	if _, err := Compile("${@secret.MISSING}").apply(nil, opts); err == nil {
+		t.Error("apply() should report the resolver error")
+	}
+
+	got, _ = Compile("${@secret.DB_PASS}").apply(nil, &ApplyOptions{MacroResolver: resolver})
+	if got.String() != "${@secret.DB_PASS}" {
+		t.Errorf("resolver should not run without ApplyMacro, got %q", got.String())
+	}
+}
+
+func TestCountByKind(t *testing.T) {
+	tmpl := Compile("${date:bash} ${whoami:bash} ${a.txt:file} ${n:%d} ${name} $name ${@timestamp}")
+	tests := []struct {
+		kind VarKind
+		want int
+	}{
+		{kind: KindBash, want: 2},
+		{kind: KindFile, want: 1},
+		{kind: KindNumber, want: 1},
+		{kind: KindPlain, want: 2},
+		{kind: KindMacro, want: 1},
+		{kind: KindHTML, want: 0},
+	}
+	for _, tt := range tests {
+		if got := tmpl.CountByKind(tt.kind); got != tt.want {
+			t.Errorf("CountByKind(%v) = %d, want %d", tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := Compile("${name} ${port?:80:%d} ${old} ${token!}")
+	b := Compile("${name} ${port?:8080:%d} ${token!:secret} ${host}")
+	d := Diff(a, b)
+	if !stringSliceEqual(d.Added, []string{"host"}) {
+		t.Errorf("Added = %v", d.Added)
+	}
+	if !stringSliceEqual(d.Removed, []string{"old"}) {
+		t.Errorf("Removed = %v", d.Removed)
+	}
+	if len(d.Changed) != 2 {
+		t.Fatalf("Changed = %+v, want 2 changes", d.Changed)
+	}
+	port, token := d.Changed[0], d.Changed[1]
+	if port.Name != "port" || !stringSliceEqual(port.Before, []string{"%d", "default=80"}) || !stringSliceEqual(port.After, []string{"%d", "default=8080"}) {
+		t.Errorf("port change = %+v", port)
+	}
+	if token.Name != "token" || !stringSliceEqual(token.Before, []string{"required"}) || !stringSliceEqual(token.After, []string{"required", "secret"}) {
+		t.Errorf("token change = %+v", token)
+	}
+	if d.Empty() {
+		t.Error("Empty() = true, want false")
+	}
+	if d := Diff(a, Compile("${token!} ${old} ${port?:80:%d} $name")); !d.Empty() {
+		t.Errorf("Diff() of equivalent templates = %+v", d)
+	}
+}
+
+func TestNestedTemplateDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{name: "fragment", template: "${url?:${scheme}://${host}}", vars: map[string]string{"scheme": "https", "host": "example.com"}, want: "https://example.com"},
+		{name: "explicit wins", template: "${url?:${scheme}://${host}}", vars: map[string]string{"url": "u", "scheme": "https"}, want: "u"},
+		{name: "missing inner keeps placeholder", template: "${url?:${scheme}://${host}}", vars: map[string]string{"scheme": "https"}, want: "${url?:${scheme}://${host}}"},
+		{name: "inner default", template: "${url?:${scheme?:http}://${host}}", vars: map[string]string{"host": "h"}, want: "http://h"},
+		{name: "multiply nested", template: "${a?:x-${b?:y-${c}}}", vars: map[string]string{"c": "z"}, want: "x-y-z"},
+		{name: "nested directive", template: "${a?:[${list:+}]}", vars: map[string]string{"list": "1,1,2"}, want: "[1,2]"},
+		{name: "directive after fragment", template: "${a?:${b} ${c}:shell_quote}", vars: map[string]string{"b": "it's", "c": "x"}, want: `'it'\''s x'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// the fragment shares validators and :once state, and substitutes once
+	validated := Compile("${u?:${a}}").WithValidators(map[string]func(string) error{
+		"a": func(v string) error { return errors.New("bad") },
+	})
+	if _, err := validated.Execute(map[string]string{"a": "x"}); err == nil {
+		t.Error("Execute() should run the validator of a inside the default")
+	}
+	if got, _ := Compile("${a:once}|${u?:${a:once}}").Execute(map[string]string{"a": "A"}); got != "A|" {
+		t.Errorf("Execute() = %q, want %q", got, "A|")
+	}
+	_, stats, err := Compile("${u?:${a}}").ExecuteWithStats(map[string]string{"a": "A"})
+	if err != nil || stats.SubstitutionCount != 1 {
+		t.Errorf("SubstitutionCount = %d, %v, want 1", stats.SubstitutionCount, err)
+	}
+}
+
+func TestRequiredGroup(t *testing.T) {
+	base := Compile("auth ${token?:} ${password?:}")
+	tests := []struct {
+		name    string
+		tmpl    *Template
+		vars    map[string]string
+		wantErr bool
+	}{
+		{name: "at least one: none", tmpl: base.WithRequiredGroup("token", "password"), vars: nil, wantErr: true},
+		{name: "at least one: one", tmpl: base.WithRequiredGroup("token", "password"), vars: map[string]string{"token": "t"}},
+		{name: "at least one: both", tmpl: base.WithRequiredGroup("token", "password"), vars: map[string]string{"token": "t", "password": "p"}},
+		{name: "exactly one: none", tmpl: base.WithExclusiveGroup("token", "password"), vars: nil, wantErr: true},
+		{name: "exactly one: one", tmpl: base.WithExclusiveGroup("token", "password"), vars: map[string]string{"password": "p"}},
+		{name: "exactly one: both", tmpl: base.WithExclusiveGroup("token", "password"), vars: map[string]string{"token": "t", "password": "p"}, wantErr: true},
+		{name: "binding counts", tmpl: base.WithRequiredGroup("token", "password").Bind("token", "t"), vars: nil},
+		{name: "alias counts", tmpl: base.WithAlias("tok", "token").WithRequiredGroup("tok", "pw"), vars: map[string]string{"token": "t"}},
+		{name: "no group", tmpl: base, vars: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.tmpl.Execute(tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := base.WithRequiredGroup("token", "password").Execute(nil); err == nil || err.Error() != "one of [token password] is required" {
+		t.Errorf("Execute() error = %v", err)
+	}
+
+	// groups change what executes, so they change the fingerprint
+	required, exclusive := base.WithRequiredGroup("token", "password"), base.WithExclusiveGroup("token", "password")
+	if base.Fingerprint() == required.Fingerprint() || required.Fingerprint() == exclusive.Fingerprint() {
+		t.Error("Fingerprint() should differ by required groups")
+	}
+}
+
+func TestVariablesInDefaults(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{template: "${a?:${b}}", want: []string{"a", "b"}},
+		{template: "${url?:${scheme?:${proto}}://${host}}", want: []string{"host", "proto", "scheme", "url"}},
+		{template: "${timeout?:${base}*2:%d}", want: []string{"base", "timeout"}},
+		{template: "${port?:$base+1}", want: []string{"base", "port"}},
+		{template: "${a?:b}", want: []string{"a"}},
+	}
+	for _, tt := range tests {
+		if got := Compile(tt.template).Variables(); !stringSliceEqual(got, tt.want) {
+			t.Errorf("Compile(%q).Variables() = %v, want %v", tt.template, got, tt.want)
+		}
+	}
+
+	missing := Compile("${a?:${b}} ${c}").PartialApply(map[string]string{"c": "C"})
+	if got := missing.Variables(); !stringSliceEqual(got, []string{"a", "b"}) {
+		t.Errorf("PartialApply().Variables() = %v, want [a b]", got)
+	}
+	if got, _ := missing.Execute(map[string]string{"b": "B"}); got != "B C" {
+		t.Errorf("Execute() = %q, want %q", got, "B C")
+	}
+}
+
+func TestEscapedMacroSigil(t *testing.T) {
+	tmpl, err := CompileStrict(`{"@type": "${\@type}", "@id": "${\@id?:none}", "ts": "${@missing_macro}"}`)
+	if err != nil {
+		t.Fatalf("CompileStrict() error = %v", err)
+	}
+	if got := tmpl.Variables(); !stringSliceEqual(got, []string{"@id", "@missing_macro", "@type"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+	if tmpl.Var(0).IsMacro() || tmpl.Var(1).IsMacro() || !tmpl.Var(2).IsMacro() {
+		t.Error(`${\@type} should not be a macro`)
+	}
+	got, err := tmpl.Execute(map[string]string{"@type": "Person", "@missing_macro": "ignored"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got != `{"@type": "Person", "@id": "none", "ts": "${@missing_macro}"}` {
+		t.Errorf("Execute() = %q", got)
+	}
+	if _, err := CompileStrict(`${\@}`); err == nil {
+		t.Error(`CompileStrict() should reject an empty escaped name`)
+	}
+}
+
+func TestMarkDefaults(t *testing.T) {
+	var marked []string
+	opts := &ApplyOptions{
+		ApplyDefault: true,
+		ApplyMacro:   true,
+		MarkDefaults: func(name string) { marked = append(marked, name) },
+	}
+	got, err := Compile("${host?:localhost}:${port?:80} ${@unknown?:x} ${user}").apply(map[string]string{"port": "8080"}, opts)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got.String() != "localhost:8080 x ${user}" {
+		t.Errorf("apply() = %q", got.String())
+	}
+	if !stringSliceEqual(marked, []string{"host", "@unknown"}) {
+		t.Errorf("MarkDefaults called with %v, want [host @unknown]", marked)
+	}
+
+	marked = nil
+	if _, err := Compile("${port?:80}").apply(map[string]string{"port": "80"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(marked) != 0 {
+		t.Errorf("MarkDefaults should not be called for a supplied value, got %v", marked)
+	}
+}
+
+func TestCompileWithLimits(t *testing.T) {
+	if _, err := CompileWithLimits("$a $b $c", 3); err != nil {
+		t.Errorf("CompileWithLimits() at the limit error = %v", err)
+	}
+	_, err := CompileWithLimits(strings.Repeat("$a", 1000), 3)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("CompileWithLimits() error = %v, want ErrLimitExceeded", err)
+	}
+	if _, err := CompileWithLimits(strings.Repeat("$a", 1000), 0); err != nil {
+		t.Errorf("CompileWithLimits() with no limit error = %v", err)
+	}
+	_, err = CompileWithOptions(strings.Repeat("x", 100), &CompileOptions{MaxLength: 64})
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("CompileWithOptions() error = %v, want ErrLimitExceeded", err)
+	}
+
+	// variables of nested defaults count too, and nesting is bounded
+	if _, err := CompileWithLimits("${a?:<${b}>}", 1); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("CompileWithLimits() nested error = %v, want ErrLimitExceeded", err)
+	}
+	deep := strings.Repeat("${a?:", 8000) + "x" + strings.Repeat("}", 8000)
+	start := time.Now()
+	if _, err := CompileWithLimits(deep, 10); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("CompileWithLimits() deep error = %v, want ErrLimitExceeded", err)
+	}
+	if _, err := CompileStrict(deep); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("CompileStrict() deep error = %v, want ErrLimitExceeded", err)
+	}
+	if Compile(deep) == nil {
+		t.Error("Compile() deep should keep the too deep default as literal text")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("compiling deeply nested defaults took %v", elapsed)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		loose string
+	}{
+		{value: "plain", want: "plain", loose: "plain"},
+		{value: "./dir/file-1.txt", want: "./dir/file-1.txt", loose: "./dir/file-1.txt"},
+		{value: "a#b", want: "'a#b'", loose: "a#b"},
+		{value: "*.txt", want: "'*.txt'", loose: "'*.txt'"},
+		{value: "~user", want: "'~user'", loose: "~user"},
+		{value: "k=v", want: "'k=v'", loose: "k=v"},
+		{value: "a?[b]", want: "'a?[b]'", loose: "a?[b]"},
+		{value: "it's", want: `'it'\''s'`, loose: "it's"},
+		{value: "it's x", want: `'it'\''s x'`, loose: `'it'\''s x'`},
+		{value: "héllo", want: "'héllo'", loose: "héllo"},
+	}
+	tmpl := Compile("${v:shell_quote}")
+	for _, tt := range tests {
+		got, err := tmpl.Execute(map[string]string{"v": tt.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("shell_quote(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+		got, err = tmpl.ExecuteWithOptions(map[string]string{"v": tt.value}, &ApplyOptions{LooseShellQuote: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.loose {
+			t.Errorf("loose shell_quote(%q) = %s, want %s", tt.value, got, tt.loose)
+		}
+	}
+
+	// an empty value stays a separate, empty argument
+	if got, _ := Compile("cmd ${v:shell_quote} y").Execute(map[string]string{"v": ""}); got != "cmd '' y" {
+		t.Errorf("shell_quote(\"\") = %s, want cmd '' y", got)
+	}
+	if quoteShellStr("") != "''" || quoteShellStrLoose("") != "''" {
+		t.Error("expected '' for an empty string")
+	}
+}
+
+func TestWithDefault(t *testing.T) {
+	tmpl := Compile("${host!}:${port?:80} $host ${user}")
+	withDefaults := tmpl.WithDefault("host", "localhost").WithDefault("port", "8080")
+
+	got, err := withDefaults.Execute(map[string]string{"user": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "localhost:8080 localhost admin" {
+		t.Errorf("Execute() = %q", got)
+	}
+	got, _ = withDefaults.Execute(map[string]string{"host": "db", "port": "5432", "user": "u"})
+	if got != "db:5432 db u" {
+		t.Errorf("Execute() with vars = %q", got)
+	}
+	if !withDefaults.HasDefaultFor("host") || withDefaults.Defaults()["port"] != "8080" {
+		t.Errorf("Defaults() = %v", withDefaults.Defaults())
+	}
+
+	// the original is untouched
+	if _, err := tmpl.Execute(map[string]string{"user": "admin"}); err == nil {
+		t.Error("expected original template to still require host")
+	}
+	if tmpl.Defaults()["port"] != "80" {
+		t.Errorf("original Defaults() = %v", tmpl.Defaults())
+	}
+
+	// computed defaults are replaced too
+	got, _ = Compile("${t?:${base}*2}").WithDefault("t", "7").Execute(map[string]string{"base": "3"})
+	if got != "7" {
+		t.Errorf("Execute() = %q, want 7", got)
+	}
+	// and the variables only they referenced
+	computed := Compile("${t?:${base}*2} ${u?:<${x}>}")
+	if got := computed.WithDefault("t", "7").WithDefault("u", "8").Variables(); !stringSliceEqual(got, []string{"t", "u"}) {
+		t.Errorf("Variables() = %v, want [t u]", got)
+	}
+	if got := computed.Variables(); !stringSliceEqual(got, []string{"base", "t", "u", "x"}) {
+		t.Errorf("original Variables() = %v, want [base t u x]", got)
+	}
+}
+
+func TestOnceDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{name: "three occurrences", template: "[${token:once}][${token:once}][${token:once}]", vars: map[string]string{"token": "T"}, want: "[T][][]"},
+		{name: "plain occurrences unaffected", template: "${a:once} ${a} ${a:once} ${a}", vars: map[string]string{"a": "x"}, want: "x x  x"},
+		{name: "per name", template: "${a:once}${b:once}${a:once}${b:once}", vars: map[string]string{"a": "1", "b": "2"}, want: "12"},
+		{name: "default", template: "${h?:Header:once},${h?:Header:once},${h?:Header:once}", vars: map[string]string{}, want: "Header,,"},
+		{name: "missing stays", template: "${x:once}-${x:once}", vars: map[string]string{}, want: "${x:once}-${x:once}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := Compile(tt.template)
+			got, err := tmpl.Execute(tt.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+			// state does not leak between renders
+			if again, _ := tmpl.Execute(tt.vars); again != got {
+				t.Errorf("second Execute() = %q, want %q", again, got)
+			}
+		})
+	}
+	if dirs := Compile("${a:once}").Var(0).Directives(); len(dirs) != 1 || dirs[0] != "once" {
+		t.Errorf("Directives() = %v", dirs)
+	}
+}
+
+func TestValidatesAsJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		wantErr  string
+	}{
+		{name: "valid with dummies", template: `{"name": "${name!}", "port": ${port:%d}}`},
+		{name: "valid with samples", template: `{"port": ${port:%d}}`, vars: map[string]string{"port": "8080"}},
+		{name: "unquoted string", template: "{\"name\": ${name}}", wantErr: "invalid JSON at line 1, column 10"},
+		{name: "unescaped value", template: "{\n  \"name\": \"${name}\"\n}", vars: map[string]string{"name": `a"b`}, wantErr: "invalid JSON at line 2, column 14"},
+		{name: "truncated", template: `{"a": ${a:%d}`, wantErr: "invalid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Compile(tt.template).ValidatesAsJSON(tt.vars)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidatesAsJSON() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidatesAsJSON() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPartialApplyWith(t *testing.T) {
+	tmpl := Compile("${host}:$port ${user!?:root} ${@timestamp}")
+	mustache := &PartialApplyOptions{Format: func(v Var) string { return "{{" + v.Name() + "}}" }}
+
+	got := tmpl.PartialApplyWith(map[string]string{"host": "db"}, mustache)
+	if got.String() != "db:{{port}} {{user}} ${@timestamp}" {
+		t.Errorf("PartialApplyWith() = %q", got.String())
+	}
+	if vars := got.Variables(); len(vars) != 1 || vars[0] != "@timestamp" {
+		t.Errorf("Variables() = %v, want only the macro left", got.Variables())
+	}
+
+	for _, opts := range []*PartialApplyOptions{nil, {}} {
+		if got := tmpl.PartialApplyWith(map[string]string{"host": "db"}, opts); got.String() != "db:$port ${user!?:root} ${@timestamp}" {
+			t.Errorf("PartialApplyWith(%v) = %q, want original leftovers", opts, got.String())
+		}
+	}
+}
+
+func TestApplyOnly(t *testing.T) {
+	tmpl := Compile("${host}:${port} ${user?:root} $db")
+	vars := map[string]string{"host": "localhost", "port": "5432", "user": "admin", "db": "app"}
+
+	partial := tmpl.ApplyOnly([]string{"host", "user", "missing"}, vars)
+	if got := partial.String(); got != "localhost:${port} admin $db" {
+		t.Errorf("ApplyOnly() = %q", got)
+	}
+	if got := partial.Variables(); len(got) != 2 || got[0] != "db" || got[1] != "port" {
+		t.Errorf("Variables() = %v, want deferred [db port]", got)
+	}
+
+	result, err := partial.Execute(vars)
+	if err != nil || result != "localhost:5432 admin app" {
+		t.Errorf("Execute() = %q, %v", result, err)
+	}
+
+	if got := tmpl.ApplyOnly(nil, vars).String(); got != tmpl.String() {
+		t.Errorf("ApplyOnly(nil) = %q, want unchanged", got)
+	}
+}
+
+func TestVisitedFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"header.txt": {Data: []byte("HEADER")},
+		"page.tmpl":  {Data: []byte("${page.tmpl:file}")},
+	}
+	render := func(src string, visited map[string]bool) (string, error) {
+		return Compile(src).ExecuteWithOptions(nil, &ApplyOptions{FS: fsys, VisitedFiles: visited})
+	}
+
+	visited := map[string]bool{"page.tmpl": true}
+	if _, err := render("${page.tmpl:file}", visited); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected self-reference error, got %v", err)
+	}
+	if _, err := render("${header.txt:file} ${./header.txt:file}", map[string]bool{}); err == nil {
+		t.Error("expected error reading header.txt twice")
+	}
+
+	visited = map[string]bool{}
+	got, err := render("${header.txt:file}", visited)
+	if err != nil || got != "HEADER" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if !visited["header.txt"] {
+		t.Errorf("expected header.txt recorded, got %v", visited)
+	}
+
+	// without the set repeated reads are allowed
+	if got, err := render("${header.txt:file}${header.txt:file}", nil); err != nil || got != "HEADERHEADER" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestExecutePairs(t *testing.T) {
+	tmpl := Compile("${k}=${v}\n\nHOST=${host?:localhost}\nURL=a=b\n")
+	got, err := tmpl.ExecutePairs(map[string]string{"k": "NAME", "v": "x y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"NAME", "x y"}, {"HOST", "localhost"}, {"URL", "a=b"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ExecutePairs() = %q, want %q", got, want)
+	}
+
+	got, err = Compile("${k}: ${v}\r\nAccept: */*").ExecutePairsSep(map[string]string{"k": "Host", "v": "example.com"}, "\r\n", ": ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = [][2]string{{"Host", "example.com"}, {"Accept", "*/*"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ExecutePairsSep() = %q, want %q", got, want)
+	}
+
+	if _, err := Compile("A=1\n${k}").ExecutePairs(map[string]string{"k": "B"}); err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("expected error on record 2, got %v", err)
+	}
+	if _, err := Compile("${k!}=1").ExecutePairs(nil); err == nil {
+		t.Error("ExecutePairs() should fail on a missing required variable")
+	}
+	if _, err := Compile("A=1").ExecutePairsSep(nil, "", "="); err == nil {
+		t.Error("ExecutePairsSep() should reject an empty separator")
+	}
+}
+
+func TestExecuteForm(t *testing.T) {
+	tmpl := Compile("q=${query:urlencode}&page=${page?:1}&tag=a&tag=b")
+	got, err := tmpl.ExecuteForm(map[string]string{"query": "a&b=c d"})
+	if err != nil {
+		t.Fatalf("ExecuteForm() error = %v", err)
+	}
+	if got.Get("q") != "a&b=c d" || got.Get("page") != "1" || !stringSliceEqual(got["tag"], []string{"a", "b"}) {
+		t.Errorf("ExecuteForm() = %v", got)
+	}
+
+	if _, err := Compile("q=${query!}").ExecuteForm(nil); err == nil {
+		t.Error("ExecuteForm() should fail on a missing required variable")
+	}
+	if _, err := Compile("q=${query}").ExecuteForm(map[string]string{"query": "%zz"}); err == nil {
+		t.Error("ExecuteForm() should propagate the parse error")
+	}
+}
+
+func TestEmptyAsMissing(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		empty    bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "empty keeps empty by default", template: "[${v?:X}]", vars: map[string]string{"v": ""}, want: "[]"},
+		{name: "empty uses default", template: "[${v?:X}]", vars: map[string]string{"v": ""}, empty: true, want: "[X]"},
+		{name: "value wins", template: "[${v?:X}]", vars: map[string]string{"v": "a"}, empty: true, want: "[a]"},
+		{name: "empty without default stays", template: "[${v}]", vars: map[string]string{"v": ""}, empty: true, want: "[${v}]"},
+		{name: "empty required", template: "[${v!}]", vars: map[string]string{"v": ""}, empty: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).apply(tt.vars, &ApplyOptions{ApplyDefault: true, ValidateRequired: true, EmptyAsMissing: tt.empty})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("apply() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    VarSpec
+		wantErr bool
+	}{
+		{raw: "name", want: VarSpec{Name: "name"}},
+		{raw: " port!?:8080:%d ", want: VarSpec{Name: "port", Required: true, HasDefault: true, Default: "8080", Directives: []string{"%d"}}},
+		{raw: "@timestamp?:0", want: VarSpec{Name: "@timestamp", HasDefault: true, Default: "0", Macro: true}},
+		{raw: "cmd:shell_quote", want: VarSpec{Name: "cmd", Directives: []string{"shell_quote"}}},
+		{raw: "?port:::", want: VarSpec{Name: "port", Conditional: true, Text: ":"}},
+		{raw: "?q", want: VarSpec{Name: "q", Conditional: true}},
+		{raw: "a:%d:+", wantErr: true},
+		{raw: "a:foo", wantErr: true},
+		{raw: "", wantErr: true},
+		{raw: "!?:x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSpec(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSpec(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got.Name != tt.want.Name || got.Required != tt.want.Required || got.HasDefault != tt.want.HasDefault ||
+			got.Default != tt.want.Default || got.Macro != tt.want.Macro || !stringSliceEqual(got.Directives, tt.want.Directives) ||
+			got.Conditional != tt.want.Conditional || got.Text != tt.want.Text {
+			t.Errorf("ParseSpec(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteKV(t *testing.T) {
+	tmpl := Compile("Hello ${name}, ${greeting?:hi}")
+	got, err := tmpl.ExecuteKV("name", "World", "greeting", "bye", "name", "Bob")
+	if err != nil {
+		t.Fatalf("ExecuteKV() error = %v", err)
+	}
+	if got != "Hello Bob, bye" {
+		t.Errorf("ExecuteKV() = %q, want %q", got, "Hello Bob, bye")
+	}
+	if _, err := tmpl.ExecuteKV("name"); err == nil {
+		t.Error("ExecuteKV() should fail on an odd number of arguments")
+	}
+	if got, _ := Compile("static").ExecuteKV(); got != "static" {
+		t.Errorf("ExecuteKV() = %q", got)
+	}
+}
+
+func TestExecuteWithOptions(t *testing.T) {
+	tmpl := Compile("${@timestamp} ${name!} ${port?:80}").Bind("name", "bound")
+	got, err := tmpl.ExecuteWithOptions(nil, &ApplyOptions{ApplyDefault: true, ValidateRequired: true})
+	if err != nil {
+		t.Fatalf("ExecuteWithOptions() error = %v", err)
+	}
+	if got != "${@timestamp} bound 80" {
+		t.Errorf("ExecuteWithOptions() = %q", got)
+	}
+
+	if _, err := Compile("${@timestamp} ${name!}").ExecuteWithOptions(nil, &ApplyOptions{ValidateRequired: true}); err == nil {
+		t.Error("ExecuteWithOptions() should validate required variables")
+	}
+
+	got, err = Compile("${@timestamp}").ExecuteWithOptions(nil, nil)
+	if err != nil || got == "${@timestamp}" {
+		t.Errorf("ExecuteWithOptions() with nil options = %q, %v, want macros resolved", got, err)
+	}
+}
+
+func TestDollarNumberDirective(t *testing.T) {
+	vars := map[string]string{"age": "3", "host": "h", "port": "80", "name": "n"}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: `{"age": "$age:%d"}`, want: `{"age": 3}`},
+		{template: `{"age": "$(age):%d"}`, want: `{"age": 3}`},
+		{template: "$host:$port", want: "h:80"},
+		{template: "$host:8080", want: "h:8080"},
+		{template: "$name:html", want: "n:html"},
+		{template: "$age:%dx", want: "3:%dx"},
+		{template: "$age:%d.", want: "3."},
+	}
+	for _, tt := range tests {
+		if got, _ := Compile(tt.template).Execute(vars); got != tt.want {
+			t.Errorf("Execute(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+	if !Compile("$age:%d").Var(0).IsNumber() {
+		t.Errorf("%q should be a number variable", "$age:%d")
+	}
+}
+
+func TestReplaceVarWithLiteral(t *testing.T) {
+	tmpl := Compile("${scheme}://${host}:$port/${host}?v=${version?:1}")
+	got := tmpl.ReplaceVarWithLiteral("host", "example.com")
+	if got.Template() != "${scheme}://example.com:$port/example.com?v=${version?:1}" {
+		t.Errorf("Template() = %q", got.Template())
+	}
+	if !stringSliceEqual(got.Variables(), []string{"port", "scheme", "version"}) {
+		t.Errorf("Variables() = %v", got.Variables())
+	}
+	out, err := got.Execute(map[string]string{"scheme": "https", "port": "443", "host": "ignored"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if out != "https://example.com:443/example.com?v=1" {
+		t.Errorf("Execute() = %q", out)
+	}
+	if tmpl.Template() != "${scheme}://${host}:$port/${host}?v=${version?:1}" || tmpl.NumVars() != 5 {
+		t.Error("ReplaceVarWithLiteral() should not modify the original template")
+	}
+
+	// the literal is not parsed
+	lit := Compile("a ${x} b").ReplaceVarWithLiteral("x", "${y}")
+	if lit.HasVariables() {
+		t.Errorf("literal should not introduce variables, got %v", lit.Variables())
+	}
+	if out, _ := lit.Execute(map[string]string{"y": "Y"}); out != "a ${y} b" {
+		t.Errorf("Execute() = %q", out)
+	}
+}
+
+func TestDefaultPreservesWhitespace(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "[${x?:  spaced  }]", want: "[  spaced  ]"},
+		{template: "[${ x ?:    }]", want: "[    ]"},
+		{template: "[${x?:\tindent}]", want: "[\tindent]"},
+		{template: "[${x?: a :shell_quote }]", want: "[' a ']"},
+		{template: `{"n": "${ n ?: 7 :%d }"}`, want: `{"n":  7 }`},
+		{template: "[${ x }]", want: "[${ x }]"},
+	}
+	for _, tt := range tests {
+		if got, _ := Compile(tt.template).Execute(nil); got != tt.want {
+			t.Errorf("Execute(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+	if got := Compile("${ x ?:  y  }").Var(0).Name(); got != "x" {
+		t.Errorf("Name() = %q, want %q", got, "x")
+	}
+}
+
+func TestWrapWith(t *testing.T) {
+	tmpl := Compile(`{"name": "${name}", "age": "$age:%d"}`)
+	wrapped := tmpl.WrapWith("// generated, do not edit ${x}\n", "\n")
+	got, err := wrapped.Execute(map[string]string{"name": "Bob", "age": "3", "x": "X"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got != "// generated, do not edit ${x}\n{\"name\": \"Bob\", \"age\": 3}\n" {
+		t.Errorf("Execute() = %q", got)
+	}
+	if !stringSliceEqual(wrapped.Variables(), []string{"age", "name"}) {
+		t.Errorf("Variables() = %v", wrapped.Variables())
+	}
+	if _, _, text := wrapped.RawSpan(0); text != "${name}" {
+		t.Errorf("RawSpan(0) = %q", text)
+	}
+	if got, _ := tmpl.Execute(map[string]string{"name": "Bob", "age": "3"}); got != `{"name": "Bob", "age": 3}` {
+		t.Errorf("original Execute() = %q", got)
+	}
+}
+
+func TestGatedTransform(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{name: "gate true", template: "ls ${path:shell_quote_if:quoting}", vars: map[string]string{"path": "a b", "quoting": "true"}, want: "ls 'a b'"},
+		{name: "gate 1", template: "ls ${path:shell_quote_if:quoting}", vars: map[string]string{"path": "a b", "quoting": "1"}, want: "ls 'a b'"},
+		{name: "gate false", template: "ls ${path:shell_quote_if:quoting}", vars: map[string]string{"path": "a b", "quoting": "false"}, want: "ls a b"},
+		{name: "gate 0", template: "ls ${path:shell_quote_if:quoting}", vars: map[string]string{"path": "a b", "quoting": "0"}, want: "ls a b"},
+		{name: "gate missing", template: "ls ${path:shell_quote_if:quoting}", vars: map[string]string{"path": "a b"}, want: "ls a b"},
+		{name: "html gate", template: "${v:html_if:escape}", vars: map[string]string{"v": "<b>", "escape": "yes"}, want: "&lt;b&gt;"},
+		{name: "urlencode gate with default", template: "${v?:a b:urlencode_if:enc}", vars: map[string]string{"enc": "TRUE"}, want: "a+b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compile(tt.template).Execute(tt.vars)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := Compile("${path:shell_quote_if:quoting}").Variables(); !stringSliceEqual(got, []string{"path", "quoting"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+	if _, err := CompileStrict("${path:shell_quote_if:}"); err == nil {
+		t.Error("CompileStrict() should reject an empty gate")
+	}
+}
+
+func TestTemplateDefaults(t *testing.T) {
+	tmpl := Compile("${host?:localhost}:${port?:8080:%d} ${name} ${empty?:} ${host?:other} ${token?:dev:secret}")
+	got := tmpl.Defaults()
+	want := map[string]string{"host": "localhost", "port": "8080", "empty": "", "token": "***"}
+	if len(got) != len(want) {
+		t.Fatalf("Defaults() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Defaults()[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+	for name, want := range map[string]bool{"host": true, "empty": true, "name": false, "missing": false} {
+		if got := tmpl.HasDefaultFor(name); got != want {
+			t.Errorf("HasDefaultFor(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestDisallowExtraVars(t *testing.T) {
+	opts := &ApplyOptions{ApplyDefault: true, DisallowExtraVars: true}
+	tmpl := Compile("${name} ${url?:${scheme}://${host}}")
+
+	if _, err := tmpl.apply(map[string]string{"name": "n", "scheme": "https", "host": "h"}, opts); err != nil {
+		t.Errorf("apply() error = %v", err)
+	}
+	_, err := tmpl.apply(map[string]string{"name": "n", "nmae": "typo", "extra": "x"}, opts)
+	if err == nil || err.Error() != "unknown variables: extra, nmae" {
+		t.Errorf("apply() error = %v, want unknown variables: extra, nmae", err)
+	}
+	if _, err := Compile("static").apply(map[string]string{"x": "1"}, opts); err == nil {
+		t.Error("apply() should reject vars for a template without variables")
+	}
+	if _, err := tmpl.apply(map[string]string{"extra": "x"}, &ApplyOptions{ApplyDefault: true}); err != nil {
+		t.Errorf("extra vars should be allowed by default, got %v", err)
+	}
+}
+
+func TestRequiredVarErrorPosition(t *testing.T) {
+	tmpl := Compile("名前: ${name}\nこんにちは, ${greeting!}")
+	_, err := tmpl.Execute(map[string]string{"name": "x"})
+	var reqErr *RequiredVarError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("Execute() error = %v, want *RequiredVarError", err)
+	}
+	if reqErr.Line != 2 || reqErr.Column != 8 {
+		t.Errorf("position = %d:%d, want 2:8", reqErr.Line, reqErr.Column)
+	}
+	if want := strings.Index(tmpl.Template(), "${greeting!}"); reqErr.Offset != want {
+		t.Errorf("Offset = %d, want byte offset %d", reqErr.Offset, want)
+	}
+	if err.Error() != "required variable greeting! is missing" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+	if line, col := tmpl.Position(len("名前: ")); line != 1 || col != 5 {
+		t.Errorf("Position() = %d:%d, want 1:5", line, col)
+	}
+}
+
+func TestCompileCached(t *testing.T) {
+	a := CompileCached("Hello ${name}")
+	b := CompileCached("Hello ${name}")
+	if a != b {
+		t.Error("CompileCached() should reuse the template for an identical source")
+	}
+	if got, _ := a.Execute(map[string]string{"name": "x"}); got != "Hello x" {
+		t.Errorf("Execute() = %q", got)
+	}
+
+	cache := newCompileCache(2)
+	first := cache.get("a ${x}")
+	cache.get("b ${x}")
+	cache.get("a ${x}") // a is now the most recently used
+	cache.get("c ${x}") // evicts b
+	if cache.get("a ${x}") != first {
+		t.Error("recently used template should stay cached")
+	}
+	if _, ok := cache.entries["b ${x}"]; ok {
+		t.Error("least recently used template should be evicted")
+	}
+	if cache.order.Len() != 2 || len(cache.entries) != 2 {
+		t.Errorf("cache size = %d/%d, want 2", cache.order.Len(), len(cache.entries))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.get("t" + strconv.Itoa((i+j)%5) + " ${x}")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cache.order.Len() > 2 {
+		t.Errorf("cache grew beyond its capacity: %d", cache.order.Len())
+	}
+}
+
+func TestPreviewMacros(t *testing.T) {
+	tmpl := Compile("${@timestamp}-${@timestamp}-${@build?:dev}-${@missing}-${@custom}-${name}")
+	calls := 0
+	opts := &ApplyOptions{
+		ApplyMacro: true,
+		Now:        func() time.Time { return time.Unix(1700000000, 0) },
+		MacroResolver: func(name string) (func() (string, error), bool) {
+			if name != "custom" {
+				return nil, false
+			}
+			return func() (string, error) {
+				calls++
+				return "c", nil
+			}, true
+		},
+	}
+	got := tmpl.PreviewMacros(opts)
+	want := map[string]string{"@timestamp": "1700000000", "@build": "dev", "@custom": "c"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got[k])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected custom macro resolved once, got %d", calls)
+	}
+
+	res, err := tmpl.ExecuteWithOptions(map[string]string{"name": "x"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "1700000000-1700000000-dev-${@missing}-c-x" {
+		t.Errorf("unexpected render %q", res)
+	}
+}